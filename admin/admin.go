@@ -0,0 +1,186 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/Doridian/foxIngress/config"
+	"github.com/Doridian/foxIngress/conn"
+	"github.com/Doridian/foxIngress/util/logging"
+)
+
+var logger = logging.New("admin")
+
+// Handler returns the handler of the admin API, which requires token as bearer token if it is not empty.
+// Without a token, the listener has to authenticate clients by their certificates.
+func Handler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /bans", listBans)
+	mux.HandleFunc("DELETE /bans/{prefix...}", removeBan)
+	mux.HandleFunc("GET /config", getConfig)
+	mux.HandleFunc("POST /reload", reload)
+	mux.HandleFunc("GET /routes", listRoutes)
+	mux.HandleFunc("GET /connections", listConnections)
+	mux.HandleFunc("DELETE /connections", killHost)
+	mux.HandleFunc("DELETE /connections/{id}", killConnection)
+	mux.HandleFunc("GET /drain", listDrained)
+	mux.HandleFunc("PUT /drain/{backend...}", drainBackend)
+	mux.HandleFunc("DELETE /drain/{backend...}", undrainBackend)
+
+	if token == "" {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqToken, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(reqToken), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+func listBans(w http.ResponseWriter, r *http.Request) {
+	bans := config.GetBans()
+	if bans == nil {
+		http.Error(w, "banning is not configured", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, bans.List())
+}
+
+func removeBan(w http.ResponseWriter, r *http.Request) {
+	bans := config.GetBans()
+	if bans == nil {
+		http.Error(w, "banning is not configured", http.StatusNotFound)
+		return
+	}
+
+	value := r.PathValue("prefix")
+	prefix, err := netip.ParsePrefix(value)
+	if err != nil {
+		addr, addrErr := netip.ParseAddr(value)
+		if addrErr != nil {
+			http.Error(w, "invalid address or prefix", http.StatusBadRequest)
+			return
+		}
+		addr = addr.Unmap()
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+
+	if bans.Unban(prefix) == 0 {
+		http.Error(w, "no such ban", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getConfig(w http.ResponseWriter, r *http.Request) {
+	data, err := config.GetConfigYAML()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	_, _ = w.Write(data)
+}
+
+func reload(w http.ResponseWriter, r *http.Request) {
+	err := config.Reload()
+	if err != nil {
+		logger.Error("Config reload failed", "error", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	logger.Info("Config reloaded")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listRoutes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, config.GetRoutingTable())
+}
+
+func listConnections(w http.ResponseWriter, r *http.Request) {
+	conns := conn.TrackedConnections()
+
+	host := strings.ToLower(r.URL.Query().Get("host"))
+	if host != "" {
+		conns = slices.DeleteFunc(conns, func(c conn.TrackedInfo) bool {
+			return c.Host != host && c.Match != host
+		})
+	}
+	writeJSON(w, conns)
+}
+
+func killConnection(w http.ResponseWriter, r *http.Request) {
+	if !conn.Kill(r.PathValue("id")) {
+		http.Error(w, "no such connection", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func killHost(w http.ResponseWriter, r *http.Request) {
+	host := r.URL.Query().Get("host")
+	if host == "" {
+		http.Error(w, "host is required", http.StatusBadRequest)
+		return
+	}
+
+	killed := conn.KillHost(host)
+	logger.Info("Killed connections", "host", host, "count", killed)
+	writeJSON(w, map[string]int{"killed": killed})
+}
+
+func listDrained(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, config.GetDrainedBackends())
+}
+
+// knownBackend returns whether any host entry or rule routes to backend
+func knownBackend(backend string) bool {
+	for _, routes := range config.GetRoutingTable() {
+		for _, route := range routes {
+			if route.Backend == backend {
+				return true
+			}
+			for _, rule := range route.Rules {
+				if rule.Backend == backend && rule.Backend != "drop" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func drainBackend(w http.ResponseWriter, r *http.Request) {
+	backend := r.PathValue("backend")
+	if !knownBackend(backend) {
+		http.Error(w, "no such backend", http.StatusNotFound)
+		return
+	}
+	config.DrainBackend(backend, true)
+	logger.Info("Draining backend", "backend", backend)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func undrainBackend(w http.ResponseWriter, r *http.Request) {
+	backend := r.PathValue("backend")
+	if !config.IsDrained(backend) {
+		http.Error(w, "backend is not drained", http.StatusNotFound)
+		return
+	}
+	config.DrainBackend(backend, false)
+	logger.Info("Stopped draining backend", "backend", backend)
+	w.WriteHeader(http.StatusNoContent)
+}
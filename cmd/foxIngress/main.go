@@ -1,40 +1,65 @@
 package main
 
 import (
-	"log"
+	"crypto/tls"
 	"net"
 	"net/http"
 	"sync"
+	"time"
 
+	"github.com/Doridian/foxIngress/admin"
 	"github.com/Doridian/foxIngress/config"
 	"github.com/Doridian/foxIngress/conn/reg"
+	"github.com/Doridian/foxIngress/health"
 	"github.com/Doridian/foxIngress/util"
+	"github.com/Doridian/foxIngress/util/logging"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+var logger = logging.New("main")
+
 var initWait sync.WaitGroup
 var listenerClosedWait sync.WaitGroup
 var privilegeDropWait sync.WaitGroup
 
-func doProxy(host string, proto config.BackendProtocol) {
+// newHTTPServer creates a server for the Prometheus and admin listeners, which does not let slow clients keep connections open
+func newHTTPServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+}
+
+func doProxy(proto config.BackendProtocol) {
 	defer func() {
 		listenerClosedWait.Done()
-		log.Fatalf("listener goroutine ended unexpectedly")
+		logging.Fatal(logger, "Listener goroutine ended unexpectedly")
 	}()
 
-	listener, err := reg.GetListenerForProto(host, proto)
+	listenerConfig, err := config.GetListenerConfig(proto)
+	if err != nil {
+		logging.Fatal(logger, "Server has no listener config", "proto", proto.String(), "error", err)
+		return
+	}
+	host := listenerConfig.Addr
+
+	listener, err := reg.GetListenerForProto(listenerConfig, proto)
 	ipProto := listener.IPProto()
 
 	initWait.Done()
 	if err != nil {
-		log.Fatalf("%s server could not listen on %s %s: %v", proto.String(), ipProto, host, err)
+		logging.Fatal(logger, "Server could not listen", "proto", proto.String(), "ipproto", ipProto, "listener", host, "error", err)
 		return
 	}
 
-	log.Printf("%s listener started on %s %s", proto.String(), ipProto, host)
+	logger.Info("Listener started", "proto", proto.String(), "ipproto", ipProto, "listener", host)
+	health.SetListenerState(proto.String(), health.ListenerBound)
 	privilegeDropWait.Wait()
 
-	log.Printf("%s listener enabled on %s %s", proto.String(), ipProto, host)
+	logger.Info("Listener enabled", "proto", proto.String(), "ipproto", ipProto, "listener", host)
+	health.SetListenerState(proto.String(), health.ListenerAccepting)
 	listener.Start()
 }
 
@@ -48,12 +73,54 @@ func promListen() {
 
 	ln, err := net.Listen("tcp", promAddr)
 	if err != nil {
-		log.Fatalf("Error starting Prometheus listener: %v", err)
+		logging.Fatal(logger, "Error starting Prometheus listener", "listener", promAddr, "error", err)
+	}
+
+	logger.Info("Prometheus listener started", "listener", promAddr)
+
+	// The health endpoints are served right away, so /readyz reports the startup until everything is ready
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", health.Healthz)
+	mux.HandleFunc("/readyz", health.Readyz)
+	go func() {
+		defer listenerClosedWait.Done()
+
+		err := newHTTPServer(mux).Serve(ln)
+		if err != nil {
+			logging.Fatal(logger, "Error serving Prometheus listener", "listener", promAddr, "error", err)
+		}
+	}()
+
+	initWait.Done()
+	privilegeDropWait.Wait()
+
+	mux.Handle("/metrics", promhttp.Handler())
+	if config.GetAdminOnPrometheus() {
+		mux.Handle("/admin/", http.StripPrefix("/admin", admin.Handler(config.GetAdminToken())))
+	}
+
+	logger.Info("Prometheus listener enabled", "listener", promAddr)
+}
+
+func adminListen() {
+	adminAddr := config.GetAdminAddr()
+	if adminAddr == "" {
+		initWait.Done()
+		listenerClosedWait.Done()
+		return
+	}
+
+	ln, err := net.Listen("tcp", adminAddr)
+	if err != nil {
+		logging.Fatal(logger, "Error starting admin listener", "listener", adminAddr, "error", err)
 	}
 
-	log.Printf("Prometheus listener started on %s", promAddr)
+	tlsConfig := config.GetAdminTLSConfig()
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
 
-	http.Handle("/metrics", promhttp.Handler())
+	logger.Info("Admin listener started", "listener", adminAddr, "tls", tlsConfig != nil)
 
 	initWait.Done()
 	privilegeDropWait.Wait()
@@ -61,31 +128,37 @@ func promListen() {
 	go func() {
 		defer listenerClosedWait.Done()
 
-		err := http.Serve(ln, nil)
+		err := newHTTPServer(admin.Handler(config.GetAdminToken())).Serve(ln)
 		if err != nil {
-			log.Fatalf("Error serving Prometheus listener: %v", err)
+			logging.Fatal(logger, "Error serving admin listener", "listener", adminAddr, "error", err)
 		}
 	}()
 
-	log.Printf("Prometheus listener enabled on %s", promAddr)
+	logger.Info("Admin listener enabled", "listener", adminAddr)
 }
 
 func main() {
-	log.Printf("foxIngress version %s", util.Version)
+	logger.Info("Starting foxIngress", "version", util.Version)
 
 	config.Load()
 
 	privilegeDropWait.Add(1)
 
-	initWait.Add(4)
-	listenerClosedWait.Add(4)
+	for _, proto := range []config.BackendProtocol{config.PROTO_HTTP, config.PROTO_HTTPS, config.PROTO_QUIC} {
+		health.SetListenerState(proto.String(), health.ListenerStarting)
+	}
+
+	initWait.Add(5)
+	listenerClosedWait.Add(5)
 	go promListen()
-	go doProxy(config.GetHTTPAddr(), config.PROTO_HTTP)
-	go doProxy(config.GetHTTPSAddr(), config.PROTO_HTTPS)
-	go doProxy(config.GetQUICAddr(), config.PROTO_QUIC)
+	go adminListen()
+	go doProxy(config.PROTO_HTTP)
+	go doProxy(config.PROTO_HTTPS)
+	go doProxy(config.PROTO_QUIC)
 
 	initWait.Wait()
-	util.DropPrivs()
+	util.DropPrivs(config.UsesTransparentBackends())
+	health.SetPrivilegesDropped()
 	privilegeDropWait.Done()
 
 	listenerClosedWait.Wait()
@@ -0,0 +1,39 @@
+package config
+
+import (
+	"github.com/Doridian/foxIngress/util/accesslog"
+)
+
+var accessLog *accesslog.Logger
+
+type accessLogEncoded struct {
+	Output   string `yaml:"output"`
+	Format   string `yaml:"format"`
+	Template string `yaml:"template"`
+}
+
+func loadAccessLog(cfg *accessLogEncoded) *accesslog.Logger {
+	if cfg == nil || cfg.Output == "" {
+		return nil
+	}
+
+	format := cfg.Format
+	if format == "" {
+		format = accesslog.FORMAT_JSON
+		if cfg.Template != "" {
+			format = accesslog.FORMAT_TEMPLATE
+		}
+	}
+
+	accessLogger, err := accesslog.New(cfg.Output, format, cfg.Template)
+	if err != nil {
+		fatalf("Could not open access log: %v", err)
+		return nil
+	}
+	return accessLogger
+}
+
+// GetAccessLog returns the access log, which is nil (but still usable) if it is disabled
+func GetAccessLog() *accesslog.Logger {
+	return accessLog
+}
@@ -0,0 +1,206 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const REDACTED = "<redacted>"
+
+var adminTLS *tls.Config
+
+type adminEncoded struct {
+	Token string `yaml:"token"`
+	// TLSCert and TLSKey make the admin listener use TLS, ClientCA additionally requires client certificates signed by it
+	TLSCert  string `yaml:"tls_cert"`
+	TLSKey   string `yaml:"tls_key"`
+	ClientCA string `yaml:"client_ca"`
+	// Prometheus also serves the admin API under /admin/ on the Prometheus listener
+	Prometheus bool `yaml:"prometheus"`
+}
+
+// RouteInfo describes the backend of a host entry and its rules, as shown by the admin API
+type RouteInfo struct {
+	Match    string      `json:"match"`
+	Backend  string      `json:"backend"`
+	Draining bool        `json:"draining"`
+	Rules    []RouteRule `json:"rules,omitempty"`
+}
+
+// RouteRule is a rule sending some connections of a host entry to another backend (or dropping them)
+type RouteRule struct {
+	Type     string `json:"type"`
+	Match    string `json:"match"`
+	Backend  string `json:"backend"`
+	Draining bool   `json:"draining"`
+}
+
+// checkAdminAuth makes sure the admin API is never served without authentication
+func checkAdminAuth(cfg adminEncoded, addr string) {
+	if cfg.Prometheus && cfg.Token == "" {
+		fatalf("Admin prometheus requires a token, as the Prometheus listener has no client certificates")
+	}
+	if addr != "" && cfg.Token == "" && cfg.ClientCA == "" {
+		fatalf("Admin listener requires a token or client_ca")
+	}
+}
+
+func loadAdminTLS(cfg adminEncoded) *tls.Config {
+	if cfg.TLSCert == "" && cfg.TLSKey == "" {
+		if cfg.ClientCA != "" {
+			fatalf("Admin client_ca requires tls_cert and tls_key")
+		}
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		fatalf("Could not load admin TLS certificate: %v", err)
+		return nil
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cfg.ClientCA != "" {
+		caPEM, err := os.ReadFile(cfg.ClientCA)
+		if err != nil {
+			fatalf("Could not read admin client CA: %v", err)
+			return nil
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(caPEM) {
+			fatalf("No certificates found in admin client CA %s", cfg.ClientCA)
+			return nil
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig
+}
+
+// GetAdminToken returns the bearer token required for the admin API (empty if only client certificates are required)
+func GetAdminToken() string {
+	return config.Admin.Token
+}
+
+// GetAdminTLSConfig returns the TLS config of the admin listener (nil if it does not use TLS)
+func GetAdminTLSConfig() *tls.Config {
+	return adminTLS
+}
+
+// GetAdminOnPrometheus returns whether the admin API is also served on the Prometheus listener
+func GetAdminOnPrometheus() bool {
+	return config.Admin.Prometheus
+}
+
+// GetConfigYAML returns the config in use as YAML, with secrets redacted
+func GetConfigYAML() ([]byte, error) {
+	cfg := *currentConfig.Load()
+	if cfg.Admin.Token != "" {
+		cfg.Admin.Token = REDACTED
+	}
+
+	// Unset settings are left out, as they are mostly nil pointers and slices
+	var node yaml.Node
+	err := node.Encode(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	pruneYAML(&node)
+	return yaml.Marshal(&node)
+}
+
+func pruneYAML(node *yaml.Node) {
+	if node.Kind != yaml.MappingNode {
+		for _, child := range node.Content {
+			pruneYAML(child)
+		}
+		return
+	}
+
+	content := node.Content[:0]
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		pruneYAML(value)
+		if isEmptyYAML(value) {
+			continue
+		}
+		content = append(content, key, value)
+	}
+	node.Content = content
+}
+
+func isEmptyYAML(node *yaml.Node) bool {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return node.Tag == "!!null" || (node.Tag == "!!str" && node.Value == "")
+	case yaml.SequenceNode:
+		return len(node.Content) == 0
+	}
+	return false
+}
+
+// GetRoutingTable returns the host entries of each protocol (http, https, quic, acme_http and acme_tls)
+func GetRoutingTable() map[string][]RouteInfo {
+	table := routing.Load()
+	return map[string][]RouteInfo{
+		"http":      routeInfos(table.http),
+		"https":     routeInfos(table.https),
+		"quic":      routeInfos(table.quic),
+		"acme_http": routeInfos(table.acmeHttp),
+		"acme_tls":  routeInfos(table.acmeTls),
+	}
+}
+
+func routeInfos(backends map[string]*BackendInfo) []RouteInfo {
+	infos := make([]RouteInfo, 0, len(backends))
+	for match, backend := range backends {
+		info := RouteInfo{
+			Match:    match,
+			Backend:  backend.String(),
+			Draining: backend.Draining(),
+		}
+		for _, route := range backend.SourceRoutes {
+			cidrs := make([]string, 0, len(route.CIDRs))
+			for _, cidr := range route.CIDRs {
+				cidrs = append(cidrs, cidr.String())
+			}
+			info.Rules = append(info.Rules, routeRule("source", strings.Join(cidrs, ","), route.Backend))
+		}
+		for _, route := range backend.ALPNRoutes {
+			info.Rules = append(info.Rules, routeRule("alpn", strings.Join(route.Protocols, ","), route.Backend))
+		}
+		for _, route := range backend.PathRoutes {
+			info.Rules = append(info.Rules, routeRule("path", route.Prefix, route.Backend))
+		}
+		for _, route := range backend.FingerprintRoutes {
+			fingerprints := slices.Concat(route.JA3, route.JA4, route.QUIC)
+			info.Rules = append(info.Rules, routeRule("fingerprint", strings.Join(fingerprints, ","), route.Backend))
+		}
+		infos = append(infos, info)
+	}
+
+	slices.SortFunc(infos, func(a RouteInfo, b RouteInfo) int {
+		return strings.Compare(a.Match, b.Match)
+	})
+	return infos
+}
+
+func routeRule(ruleType string, match string, backend *BackendInfo) RouteRule {
+	rule := RouteRule{
+		Type:    ruleType,
+		Match:   match,
+		Backend: "drop",
+	}
+	if backend != nil {
+		rule.Backend = backend.String()
+		rule.Draining = backend.Draining()
+	}
+	return rule
+}
@@ -0,0 +1,77 @@
+package config
+
+import (
+	"time"
+
+	"github.com/Doridian/foxIngress/util/ban"
+)
+
+const (
+	defaultBanDuration = time.Hour
+	defaultBanWindow   = time.Minute
+)
+
+var banManager *ban.Manager
+
+type bansEncoded struct {
+	// SniffFailures, UnknownHosts and Limited are the number of each event within Window which get a client banned
+	SniffFailures int            `yaml:"sniff_failures"`
+	UnknownHosts  int            `yaml:"unknown_hosts"`
+	Limited       int            `yaml:"limited"`
+	Window        *time.Duration `yaml:"window"`
+	Duration      *time.Duration `yaml:"duration"`
+	IPv6Prefix    *int           `yaml:"ipv6_prefix"`
+	File          string         `yaml:"file"`
+}
+
+func loadBans(cfg *bansEncoded) *ban.Manager {
+	if cfg == nil {
+		return nil
+	}
+
+	if cfg.SniffFailures < 0 || cfg.UnknownHosts < 0 || cfg.Limited < 0 {
+		fatalf("Negative ban thresholds specified")
+		return nil
+	}
+
+	banCfg := ban.Config{
+		Thresholds: map[ban.Event]int{
+			ban.EventSniffFailure: cfg.SniffFailures,
+			ban.EventUnknownHost:  cfg.UnknownHosts,
+			ban.EventLimited:      cfg.Limited,
+		},
+		Window:   defaultBanWindow,
+		Duration: defaultBanDuration,
+		IPv6Bits: defaultIPv6LimitPrefix,
+		File:     cfg.File,
+	}
+	if cfg.Window != nil {
+		banCfg.Window = *cfg.Window
+	}
+	if cfg.Duration != nil {
+		banCfg.Duration = *cfg.Duration
+	}
+	if cfg.IPv6Prefix != nil {
+		banCfg.IPv6Bits = *cfg.IPv6Prefix
+	}
+	if banCfg.Window <= 0 || banCfg.Duration <= 0 {
+		fatalf("Invalid ban window %v or duration %v specified", banCfg.Window, banCfg.Duration)
+		return nil
+	}
+	if banCfg.IPv6Bits <= 0 || banCfg.IPv6Bits > 128 {
+		fatalf("Invalid IPv6 prefix length %d specified for bans", banCfg.IPv6Bits)
+		return nil
+	}
+
+	manager, err := ban.New(banCfg)
+	if err != nil {
+		fatalf("Could not load bans from %s: %v", cfg.File, err)
+		return nil
+	}
+	return manager
+}
+
+// GetBans returns the manager of banned clients (nil if banning is not configured)
+func GetBans() *ban.Manager {
+	return banManager
+}
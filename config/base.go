@@ -3,21 +3,27 @@ package config
 import (
 	"errors"
 	"fmt"
-	"log"
+	"net/http"
+	"net/netip"
 	"os"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/Doridian/foxIngress/util/limit"
+	"github.com/Doridian/foxIngress/util/logging"
+	"github.com/Doridian/foxIngress/util/proxy"
 	"gopkg.in/yaml.v3"
 )
 
-var backendsHttp map[string]*BackendInfo
-var backendsHttps map[string]*BackendInfo
-var backendsQuic map[string]*BackendInfo
-var wildcardsEnabled = false
-var Verbose = false
-
+// config is the config loaded on startup, settings which can not be reloaded are taken from it
 var config configBase
 
+// currentConfig is the config last loaded or reloaded
+var currentConfig atomic.Pointer[configBase]
+
 type BackendProtocol int
 
 const (
@@ -41,28 +47,162 @@ func (p *BackendProtocol) String() string {
 
 const HOST_DEFAULT = "__default__"
 
+type ProxyProtocolVersion int
+
+const (
+	PROXY_MODE_ONCE         = "once"
+	PROXY_MODE_PER_DATAGRAM = "per_datagram"
+)
+
+const (
+	PROXY_NONE ProxyProtocolVersion = iota
+	PROXY_V1
+	PROXY_V2
+)
+
+// UnmarshalYAML accepts v1 or v2, as well as booleans for compatibility (true meaning v2)
+func (v *ProxyProtocolVersion) UnmarshalYAML(value *yaml.Node) error {
+	var enabled bool
+	if value.Decode(&enabled) == nil {
+		*v = PROXY_NONE
+		if enabled {
+			*v = PROXY_V2
+		}
+		return nil
+	}
+
+	var version string
+	if err := value.Decode(&version); err != nil {
+		return err
+	}
+	switch strings.ToLower(version) {
+	case "", "none":
+		*v = PROXY_NONE
+	case "v1", "1":
+		*v = PROXY_V1
+	case "v2", "2":
+		*v = PROXY_V2
+	default:
+		return fmt.Errorf("invalid PROXY protocol version %q", version)
+	}
+	return nil
+}
+
+// MarshalYAML writes the version the way UnmarshalYAML accepts it
+func (v ProxyProtocolVersion) MarshalYAML() (any, error) {
+	switch v {
+	case PROXY_V1:
+		return "v1", nil
+	case PROXY_V2:
+		return "v2", nil
+	}
+	return "none", nil
+}
+
+// ProxyProtocolTLVs selects which TLVs are added to PROXY protocol v2 headers
+type ProxyProtocolTLVs struct {
+	Authority bool `yaml:"authority"`
+	ALPN      bool `yaml:"alpn"`
+	UniqueID  bool `yaml:"unique_id"`
+	CRC32C    bool `yaml:"crc32c"`
+	// JA3 and JA4 are the (custom) TLV types to send the fingerprints of TLS clients in, 0 to not send them
+	JA3    uint8              `yaml:"ja3"`
+	JA4    uint8              `yaml:"ja4"`
+	Custom []ProxyProtocolTLV `yaml:"custom"`
+}
+
+type ProxyProtocolTLV struct {
+	Type  uint8  `yaml:"type"`
+	Value string `yaml:"value"`
+}
+
 type BackendInfo struct {
 	Host string
 	Port int
 
-	ProxyProtocol   bool
-	HostPassthrough bool
-	Match           string
+	ProxyProtocol     ProxyProtocolVersion
+	ProxyProtocolTLVs *ProxyProtocolTLVs
+	// ProxyProtocolPerDatagram prefixes every datagram sent to a UDP backend with the header,
+	// instead of sending it once as a separate datagram
+	ProxyProtocolPerDatagram bool
+	HostPassthrough          bool
+	Transparent              bool
+	Match                    string
+
+	// Limiter limits the connections of each client to this backend (nil if not configured)
+	Limiter *limit.Limiter
+
+	// Block and Tarpit are set on the backends of fingerprint rules which do not route to another backend
+	Block  bool
+	Tarpit bool
+	// Slots limits the connections of all clients to this backend (nil if not configured)
+	Slots *limit.Semaphore
+
+	Redirect     string
+	RedirectCode int
+	RedirectHost string
+
+	Allow []netip.Prefix
+	Deny  []netip.Prefix
+
+	AllowCountries []string
+	DenyCountries  []string
+	AllowASNs      []uint
+	DenyASNs       []uint
+
+	FingerprintRoutes []*FingerprintRoute
+	SourceRoutes      []*SourceRoute
+	ALPNRoutes        []*ALPNRoute
+	PathRoutes        []*PathRoute
+
+	// drainKey is String, computed when loading as it is looked up for every connection
+	drainKey string
 }
 
 func (b *BackendInfo) String() string {
 	if b == nil {
 		return "nil"
 	}
+	if b.Redirect != "" {
+		return fmt.Sprintf("redirect:%s", b.Redirect)
+	}
+	if b.Block {
+		return FINGERPRINT_ACTION_BLOCK
+	}
+	if b.Tarpit {
+		return FINGERPRINT_ACTION_TARPIT
+	}
 	return fmt.Sprintf("%s:%d", b.Host, b.Port)
 }
 
 type backendInfoEncoded struct {
-	Host            *string `yaml:"host"`
-	Port            *int    `yaml:"port"`
-	Disabled        *bool   `yaml:"disabled"`
-	ProxyProtocol   *bool   `yaml:"proxy_protocol"`
-	HostPassthrough *bool   `yaml:"host_passthrough"`
+	Host              *string               `yaml:"host"`
+	Port              *int                  `yaml:"port"`
+	Disabled          *bool                 `yaml:"disabled"`
+	ProxyProtocol     *ProxyProtocolVersion `yaml:"proxy_protocol"`
+	ProxyProtocolTLVs *ProxyProtocolTLVs    `yaml:"proxy_protocol_tlvs"`
+	ProxyProtocolMode *string               `yaml:"proxy_protocol_mode"`
+	HostPassthrough   *bool                 `yaml:"host_passthrough"`
+	Transparent       *bool                 `yaml:"transparent"`
+	Redirect          *string               `yaml:"redirect"`
+	RedirectCode      *int                  `yaml:"redirect_code"`
+	RedirectHost      *string               `yaml:"redirect_host"`
+	Limits            *limitsEncoded        `yaml:"limits"`
+	MaxConnections    *int                  `yaml:"max_connections"`
+	QueueTimeout      *time.Duration        `yaml:"queue_timeout"`
+
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+
+	AllowCountries []string `yaml:"allow_countries"`
+	DenyCountries  []string `yaml:"deny_countries"`
+	AllowASNs      []uint   `yaml:"allow_asns"`
+	DenyASNs       []uint   `yaml:"deny_asns"`
+
+	SourceRoutes []*sourceRouteEncoded      `yaml:"source_routes"`
+	ALPN         []*alpnRouteEncoded        `yaml:"alpn"`
+	Paths        []*pathRouteEncoded        `yaml:"paths"`
+	Fingerprints []*fingerprintRouteEncoded `yaml:"fingerprints"`
 }
 
 type configHost struct {
@@ -70,6 +210,8 @@ type configHost struct {
 	Http     *backendInfoEncoded `yaml:"http"`
 	Https    *backendInfoEncoded `yaml:"https"`
 	Quic     *backendInfoEncoded `yaml:"quic"`
+	AcmeHttp *backendInfoEncoded `yaml:"acme_http"`
+	AcmeTls  *backendInfoEncoded `yaml:"acme_tls"`
 	Template string              `yaml:"template"`
 }
 
@@ -79,22 +221,36 @@ type configBase struct {
 	} `yaml:"defaults"`
 	Templates map[string]configHost `yaml:"templates"`
 	Hosts     map[string]configHost `yaml:"hosts"`
+	Limits    *limitsEncoded        `yaml:"limits"`
+	Bans      *bansEncoded          `yaml:"bans"`
+	GeoIP     geoIPEncoded          `yaml:"geoip"`
+	Logging   loggingEncoded        `yaml:"logging"`
+	AccessLog *accessLogEncoded     `yaml:"access_log"`
+	Metrics   metricsEncoded        `yaml:"metrics"`
+	Health    healthEncoded         `yaml:"health"`
+	Admin     adminEncoded          `yaml:"admin"`
 	Listeners struct {
-		Http       string `yaml:"http"`
-		Https      string `yaml:"https"`
-		Quic       string `yaml:"quic"`
-		Prometheus string `yaml:"prometheus"`
+		Http       listenerConfigEncoded `yaml:"http"`
+		Https      listenerConfigEncoded `yaml:"https"`
+		Quic       listenerConfigEncoded `yaml:"quic"`
+		Prometheus string                `yaml:"prometheus"`
+		Admin      string                `yaml:"admin"`
 	}
 }
 
 func findBackend(hostname string, backends map[string]*BackendInfo) (*BackendInfo, error) {
-	backend, ok := backends[hostname]
+	backend, ok := matchBackend(hostname, backends)
 	if ok {
 		return backend, nil
 	}
+	return backends[HOST_DEFAULT], nil
+}
 
-	if !wildcardsEnabled {
-		return backends[HOST_DEFAULT], nil
+// matchBackend looks up hostname (and, if enabled, its wildcards) without falling back to the default backend
+func matchBackend(hostname string, backends map[string]*BackendInfo) (*BackendInfo, bool) {
+	backend, ok := backends[hostname]
+	if ok || !routing.Load().wildcards {
+		return backend, ok
 	}
 
 	hostSplit := strings.Split(hostname, ".")
@@ -104,33 +260,77 @@ func findBackend(hostname string, backends map[string]*BackendInfo) (*BackendInf
 		hostSplit = hostSplit[1:]
 	}
 	if len(hostSplit) == 0 {
-		return backends[HOST_DEFAULT], nil
+		return nil, false
 	}
-	return findBackend("_."+strings.Join(hostSplit, "."), backends)
+	return matchBackend("_."+strings.Join(hostSplit, "."), backends)
 }
 
 func GetBackend(hostname string, protocol BackendProtocol) (*BackendInfo, error) {
+	backends, err := getBackends(protocol)
+	if err != nil {
+		return nil, err
+	}
+	return findBackend(hostname, backends)
+}
+
+func getBackends(protocol BackendProtocol) (map[string]*BackendInfo, error) {
 	var backends map[string]*BackendInfo
+	table := routing.Load()
 	switch protocol {
 	case PROTO_HTTP:
-		backends = backendsHttp
+		backends = table.http
 	case PROTO_HTTPS:
-		backends = backendsHttps
+		backends = table.https
 	case PROTO_QUIC:
-		backends = backendsQuic
+		backends = table.quic
 	default:
 		return nil, errors.New("invalid protocol")
 	}
-	return findBackend(hostname, backends)
+	return backends, nil
 }
 
-func loadBackendConfig(match string, cfgs ...*backendInfoEncoded) *BackendInfo {
+func loadBackendConfig(match string, protocol BackendProtocol, cfgs ...*backendInfoEncoded) *BackendInfo {
+	info := loadSingleBackendConfig(match, protocol, cfgs...)
+	if info == nil {
+		return nil
+	}
+
+	info.SourceRoutes = loadSourceRoutes(match, protocol, cfgs)
+	switch protocol {
+	case PROTO_HTTP:
+		info.PathRoutes = loadPathRoutes(match, protocol, cfgs)
+	case PROTO_HTTPS, PROTO_QUIC:
+		info.FingerprintRoutes = loadFingerprintRoutes(match, protocol, cfgs)
+		info.ALPNRoutes = loadALPNRoutes(match, protocol, cfgs)
+	}
+	return info
+}
+
+func loadSingleBackendConfig(match string, protocol BackendProtocol, cfgs ...*backendInfoEncoded) *BackendInfo {
 	var host *string = nil
 	var port *int = nil
 	var disabled *bool = nil
 
-	var proxyProto *bool = nil
+	var proxyProto *ProxyProtocolVersion = nil
+	var proxyProtoTLVs *ProxyProtocolTLVs = nil
+	var proxyProtoMode *string = nil
 	var hostPass *bool = nil
+	var transparent *bool = nil
+
+	var redirect *string = nil
+	var redirectCode *int = nil
+	var redirectHost *string = nil
+
+	var allow []string = nil
+	var deny []string = nil
+	var allowCountries []string = nil
+	var denyCountries []string = nil
+	var allowASNs []uint = nil
+	var denyASNs []uint = nil
+
+	var limits *limitsEncoded = nil
+	var maxConns *int = nil
+	var queueTimeout *time.Duration = nil
 
 	isConfigured := false
 
@@ -153,9 +353,57 @@ func loadBackendConfig(match string, cfgs ...*backendInfoEncoded) *BackendInfo {
 		if proxyProto == nil {
 			proxyProto = cfg.ProxyProtocol
 		}
+		if proxyProtoTLVs == nil {
+			proxyProtoTLVs = cfg.ProxyProtocolTLVs
+		}
+		if proxyProtoMode == nil {
+			proxyProtoMode = cfg.ProxyProtocolMode
+		}
 		if hostPass == nil {
 			hostPass = cfg.HostPassthrough
 		}
+		if transparent == nil {
+			transparent = cfg.Transparent
+		}
+
+		if redirect == nil {
+			redirect = cfg.Redirect
+		}
+		if redirectCode == nil {
+			redirectCode = cfg.RedirectCode
+		}
+		if redirectHost == nil {
+			redirectHost = cfg.RedirectHost
+		}
+
+		if allow == nil {
+			allow = cfg.Allow
+		}
+		if deny == nil {
+			deny = cfg.Deny
+		}
+		if allowCountries == nil {
+			allowCountries = cfg.AllowCountries
+		}
+		if denyCountries == nil {
+			denyCountries = cfg.DenyCountries
+		}
+		if allowASNs == nil {
+			allowASNs = cfg.AllowASNs
+		}
+		if denyASNs == nil {
+			denyASNs = cfg.DenyASNs
+		}
+
+		if limits == nil {
+			limits = cfg.Limits
+		}
+		if maxConns == nil {
+			maxConns = cfg.MaxConnections
+		}
+		if queueTimeout == nil {
+			queueTimeout = cfg.QueueTimeout
+		}
 	}
 
 	if !isConfigured {
@@ -166,94 +414,301 @@ func loadBackendConfig(match string, cfgs ...*backendInfoEncoded) *BackendInfo {
 		return nil
 	}
 
-	if host == nil || *host == "" {
-		log.Fatalf("No or empty host specified for backend %s", match)
+	var info *BackendInfo
+	if redirect != nil && *redirect != "" {
+		info = loadRedirectConfig(match, protocol, *redirect, redirectCode, redirectHost)
+	} else {
+		if host == nil || *host == "" {
+			fatalf("No or empty host specified for backend %s", match)
+			return nil
+		}
+
+		if port == nil || *port <= 0 || *port > 65535 {
+			fatalf("No or invalid port specified for backend %s", match)
+			return nil
+		}
+
+		info = &BackendInfo{
+			Host:  *host,
+			Port:  *port,
+			Match: match,
+		}
+		if proxyProto != nil {
+			info.ProxyProtocol = *proxyProto
+		}
+		if info.ProxyProtocol == PROXY_V1 && protocol == PROTO_QUIC {
+			fatalf("PROXY protocol v1 does not support UDP, specified for QUIC backend %s", match)
+			return nil
+		}
+		if proxyProtoTLVs != nil {
+			for _, tlv := range proxyProtoTLVs.Custom {
+				if tlv.Type < proxy.TLVTypeMinCustom || tlv.Type > proxy.TLVTypeMaxCustom {
+					fatalf("Custom PROXY protocol TLV type 0x%02X outside of range 0x%02X-0x%02X for backend %s", tlv.Type, proxy.TLVTypeMinCustom, proxy.TLVTypeMaxCustom, match)
+					return nil
+				}
+			}
+			for _, tlvType := range []uint8{proxyProtoTLVs.JA3, proxyProtoTLVs.JA4} {
+				if tlvType != 0 && (tlvType < proxy.TLVTypeMinCustom || tlvType > proxy.TLVTypeMaxCustom) {
+					fatalf("Fingerprint PROXY protocol TLV type 0x%02X outside of range 0x%02X-0x%02X for backend %s", tlvType, proxy.TLVTypeMinCustom, proxy.TLVTypeMaxCustom, match)
+					return nil
+				}
+			}
+			info.ProxyProtocolTLVs = proxyProtoTLVs
+		}
+		if proxyProtoMode != nil {
+			switch *proxyProtoMode {
+			case "", PROXY_MODE_ONCE:
+			case PROXY_MODE_PER_DATAGRAM:
+				if protocol != PROTO_QUIC {
+					fatalf("PROXY protocol mode %s is only supported for QUIC, specified for backend %s", *proxyProtoMode, match)
+					return nil
+				}
+				if info.ProxyProtocol != PROXY_V2 {
+					fatalf("PROXY protocol mode %s requires proxy_protocol v2, specified for backend %s", *proxyProtoMode, match)
+					return nil
+				}
+				info.ProxyProtocolPerDatagram = true
+			default:
+				fatalf("Invalid PROXY protocol mode %s specified for backend %s", *proxyProtoMode, match)
+				return nil
+			}
+		}
+		if hostPass != nil {
+			info.HostPassthrough = *hostPass
+		}
+		if transparent != nil {
+			info.Transparent = *transparent
+		}
+		if info.Transparent && runtime.GOOS != "linux" {
+			fatalf("Transparent proxying is only supported on Linux, specified for backend %s", match)
+			return nil
+		}
+	}
+
+	info.Allow = loadPrefixes("backend "+match, allow)
+	info.Deny = loadPrefixes("backend "+match, deny)
+	info.AllowCountries = loadCountries("backend "+match, allowCountries)
+	info.DenyCountries = loadCountries("backend "+match, denyCountries)
+	info.AllowASNs = loadASNs("backend "+match, allowASNs)
+	info.DenyASNs = loadASNs("backend "+match, denyASNs)
+	info.Limiter = loadLimiter("backend "+match, limits)
+	info.Slots = loadSemaphore("backend "+match, maxConns, queueTimeout)
+	info.drainKey = info.String()
+	return info
+}
+
+func loadRedirectConfig(match string, protocol BackendProtocol, redirect string, redirectCode *int, redirectHost *string) *BackendInfo {
+	if protocol != PROTO_HTTP {
+		fatalf("Redirect specified for non-HTTP backend %s", match)
 		return nil
 	}
 
-	if port == nil || *port <= 0 || *port > 65535 {
-		log.Fatalf("No or invalid port specified for backend %s", match)
+	if redirect != "http" && redirect != "https" {
+		fatalf("Invalid redirect scheme %s specified for backend %s", redirect, match)
 		return nil
 	}
 
 	info := &BackendInfo{
-		Host:  *host,
-		Port:  *port,
-		Match: match,
+		Match:        match,
+		Redirect:     redirect,
+		RedirectCode: http.StatusMovedPermanently,
 	}
-	if proxyProto != nil {
-		info.ProxyProtocol = *proxyProto
+	if redirectCode != nil {
+		switch *redirectCode {
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+			info.RedirectCode = *redirectCode
+		default:
+			fatalf("Invalid redirect code %d specified for backend %s", *redirectCode, match)
+			return nil
+		}
 	}
-	if hostPass != nil {
-		info.HostPassthrough = *hostPass
+	if redirectHost != nil {
+		info.RedirectHost = *redirectHost
 	}
 	return info
 }
 
+// routingTable holds the backends of all hosts, it is replaced as a whole when the config is reloaded
+type routingTable struct {
+	http      map[string]*BackendInfo
+	https     map[string]*BackendInfo
+	quic      map[string]*BackendInfo
+	acmeHttp  map[string]*BackendInfo
+	acmeTls   map[string]*BackendInfo
+	wildcards bool
+	// slots are the semaphores of max_connections, shared by all host entries and rules using the same backend
+	slots map[string]*limit.Semaphore
+}
+
+var routing atomic.Pointer[routingTable]
+
+// reloadLock serializes reloads
+var reloadLock sync.Mutex
+
 func Load() {
-	if os.Getenv("VERBOSE") != "" {
-		Verbose = true
+	err := catchConfigError(func() {
+		config = readConfigFile()
+		currentConfig.Store(&config)
+		loadLogging(config.Logging)
+
+		listenerHttp = loadListenerConfig("http", config.Listeners.Http)
+		listenerHttps = loadListenerConfig("https", config.Listeners.Https)
+		listenerQuic = loadListenerConfig("quic", config.Listeners.Quic)
+		banManager = loadBans(config.Bans)
+		loadGeoIP(config.GeoIP)
+		accessLog = loadAccessLog(config.AccessLog)
+		checkAdminAuth(config.Admin, config.Listeners.Admin)
+		adminTLS = loadAdminTLS(config.Admin)
+		healthConfig = loadHealthConfig(config.Health)
+
+		clientLimiter.Store(loadLimiter("all connections", config.Limits))
+		metricsConfig.Store(loadMetricsConfig(config.Metrics))
+		routing.Store(loadRoutingTable(&config))
+	})
+	if err != nil {
+		logging.Fatal(logger, err.Error())
 	}
+	logRoutingTable()
+}
+
+// Reload reads the config file again and applies its hosts, templates, defaults, limits, metrics and logging settings.
+// All other settings need a restart. If the config is invalid, the old one is kept.
+func Reload() error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	return catchConfigError(func() {
+		newConfig := readConfigFile()
+		// Load everything before applying anything, so an invalid config changes nothing
+		newLimiter := keepLimiter(clientLimiter.Load(), loadLimiter("all connections", newConfig.Limits))
+		newMetricsConfig := loadMetricsConfig(newConfig.Metrics)
+		newRouting := loadRoutingTable(&newConfig)
+		keepBackendLimits(routing.Load(), newRouting)
+		loadLogging(newConfig.Logging)
+
+		// Settings which need a restart are kept, so they are shown as they are in use
+		newConfig.Listeners = config.Listeners
+		newConfig.Bans = config.Bans
+		newConfig.GeoIP = config.GeoIP
+		newConfig.AccessLog = config.AccessLog
+		newConfig.Admin = config.Admin
+		newConfig.Health = config.Health
+		currentConfig.Store(&newConfig)
+
+		clientLimiter.Store(newLimiter)
+		metricsConfig.Store(newMetricsConfig)
+		routing.Store(newRouting)
+		logRoutingTable()
+	})
+}
 
+func readConfigFile() configBase {
 	cName := os.Getenv("CONFIG_FILE")
 	if cName == "" {
 		cName = "config.yml"
 	}
 	file, err := os.Open(cName)
 	if err != nil {
-		log.Fatalf("Could not open config file: %v", err)
+		fatalf("Could not open config file: %v", err)
 	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	var cfg configBase
 	decoder := yaml.NewDecoder(file)
-	err = decoder.Decode(&config)
+	err = decoder.Decode(&cfg)
 	if err != nil {
-		log.Fatalf("Could not open decode file: %v", err)
+		fatalf("Could not open decode file: %v", err)
 	}
+	return cfg
+}
 
-	backendsHttp = make(map[string]*BackendInfo)
-	backendsHttps = make(map[string]*BackendInfo)
-	backendsQuic = make(map[string]*BackendInfo)
+func loadRoutingTable(cfg *configBase) *routingTable {
+	table := &routingTable{
+		http:     make(map[string]*BackendInfo),
+		https:    make(map[string]*BackendInfo),
+		quic:     make(map[string]*BackendInfo),
+		acmeHttp: make(map[string]*BackendInfo),
+		acmeTls:  make(map[string]*BackendInfo),
+	}
 
-	for match, rawHostConfig := range config.Hosts {
+	for match, rawHostConfig := range cfg.Hosts {
 		hostConfig := rawHostConfig
 		if rawHostConfig.Template != "" {
-			hostConfig = config.Templates[hostConfig.Template]
+			hostConfig = cfg.Templates[hostConfig.Template]
 		}
 
-		if !wildcardsEnabled && strings.HasPrefix(match, "_.") {
-			wildcardsEnabled = true
+		if !table.wildcards && strings.HasPrefix(match, "_.") {
+			table.wildcards = true
 		}
 
-		cfg := loadBackendConfig(match, hostConfig.Http, hostConfig.Default, config.Defaults.Backends.Http, config.Defaults.Backends.Default)
-		if cfg != nil {
-			backendsHttp[match] = cfg
+		backendCfg := loadBackendConfig(match, PROTO_HTTP, hostConfig.Http, hostConfig.Default, cfg.Defaults.Backends.Http, cfg.Defaults.Backends.Default)
+		if backendCfg != nil {
+			table.http[match] = backendCfg
 		}
 
-		cfg = loadBackendConfig(match, hostConfig.Https, hostConfig.Default, config.Defaults.Backends.Https, config.Defaults.Backends.Default)
-		if cfg != nil {
-			backendsHttps[match] = cfg
+		backendCfg = loadBackendConfig(match, PROTO_HTTPS, hostConfig.Https, hostConfig.Default, cfg.Defaults.Backends.Https, cfg.Defaults.Backends.Default)
+		if backendCfg != nil {
+			table.https[match] = backendCfg
 		}
 
-		cfg = loadBackendConfig(match, hostConfig.Quic, hostConfig.Default, config.Defaults.Backends.Quic, config.Defaults.Backends.Default)
-		if cfg != nil {
-			backendsQuic[match] = cfg
+		backendCfg = loadBackendConfig(match, PROTO_QUIC, hostConfig.Quic, hostConfig.Default, cfg.Defaults.Backends.Quic, cfg.Defaults.Backends.Default)
+		if backendCfg != nil {
+			table.quic[match] = backendCfg
+		}
+
+		backendCfg = loadBackendConfig(match, PROTO_HTTP, hostConfig.AcmeHttp, cfg.Defaults.Backends.AcmeHttp)
+		if backendCfg != nil {
+			table.acmeHttp[match] = backendCfg
+		}
+
+		backendCfg = loadBackendConfig(match, PROTO_HTTPS, hostConfig.AcmeTls, cfg.Defaults.Backends.AcmeTls)
+		if backendCfg != nil {
+			table.acmeTls[match] = backendCfg
 		}
 	}
 
-	log.Printf("Loaded config with %d HTTP host(s), %d HTTPS host(s), %d QUIC host(s), wildard matching %v, verbose %v", len(backendsHttp), len(backendsHttps), len(backendsQuic), wildcardsEnabled, Verbose)
-}
+	// Global ACME backends also apply to hosts that are not configured at all
+	if _, ok := table.acmeHttp[HOST_DEFAULT]; !ok {
+		backendCfg := loadBackendConfig(HOST_DEFAULT, PROTO_HTTP, cfg.Defaults.Backends.AcmeHttp)
+		if backendCfg != nil {
+			table.acmeHttp[HOST_DEFAULT] = backendCfg
+		}
+	}
+	if _, ok := table.acmeTls[HOST_DEFAULT]; !ok {
+		backendCfg := loadBackendConfig(HOST_DEFAULT, PROTO_HTTPS, cfg.Defaults.Backends.AcmeTls)
+		if backendCfg != nil {
+			table.acmeTls[HOST_DEFAULT] = backendCfg
+		}
+	}
 
-func GetHTTPAddr() string {
-	return config.Listeners.Http
+	shareBackendSlots(table)
+	return table
 }
 
-func GetHTTPSAddr() string {
-	return config.Listeners.Https
+// UsesTransparentBackends returns whether any host entry or rule connects to its backend transparently
+func UsesTransparentBackends() bool {
+	table := routing.Load()
+
+	transparent := false
+	for _, backends := range []map[string]*BackendInfo{table.http, table.https, table.quic, table.acmeHttp, table.acmeTls} {
+		forEachBackend(backends, func(backend *BackendInfo) {
+			transparent = transparent || backend.Transparent
+		})
+	}
+	return transparent
 }
 
-func GetQUICAddr() string {
-	return config.Listeners.Quic
+func logRoutingTable() {
+	table := routing.Load()
+	logger.Info("Loaded config", "http_hosts", len(table.http), "https_hosts", len(table.https), "quic_hosts", len(table.quic), "acme_http_hosts", len(table.acmeHttp), "acme_tls_hosts", len(table.acmeTls), "wildcards", table.wildcards)
 }
 
 func GetPrometheusAddr() string {
 	return config.Listeners.Prometheus
 }
+
+func GetAdminAddr() string {
+	return config.Listeners.Admin
+}
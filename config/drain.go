@@ -0,0 +1,55 @@
+package config
+
+import (
+	"errors"
+	"slices"
+	"sync"
+)
+
+// ErrDraining is returned by Route along with the matched backend if the backend is being drained
+var ErrDraining = errors.New("backend is draining")
+
+var drainLock sync.RWMutex
+var drainedBackends = make(map[string]bool)
+
+// DrainBackend stops (or with drain false resumes) routing new connections to backend, as in BackendInfo.String.
+// Open connections are kept. Draining is not affected by reloads.
+func DrainBackend(backend string, drain bool) {
+	drainLock.Lock()
+	defer drainLock.Unlock()
+
+	if drain {
+		drainedBackends[backend] = true
+	} else {
+		delete(drainedBackends, backend)
+	}
+}
+
+// IsDrained returns whether backend, as in BackendInfo.String, is being drained
+func IsDrained(backend string) bool {
+	drainLock.RLock()
+	defer drainLock.RUnlock()
+
+	return drainedBackends[backend]
+}
+
+// GetDrainedBackends returns the backends being drained
+func GetDrainedBackends() []string {
+	drainLock.RLock()
+	defer drainLock.RUnlock()
+
+	backends := make([]string, 0, len(drainedBackends))
+	for backend := range drainedBackends {
+		backends = append(backends, backend)
+	}
+	slices.Sort(backends)
+	return backends
+}
+
+// Draining returns whether new connections to the backend are rejected
+func (b *BackendInfo) Draining() bool {
+	drainLock.RLock()
+	defer drainLock.RUnlock()
+
+	return drainedBackends[b.drainKey]
+}
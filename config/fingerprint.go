@@ -0,0 +1,71 @@
+package config
+
+import (
+	"slices"
+)
+
+const (
+	FINGERPRINT_ACTION_ROUTE  = ""
+	FINGERPRINT_ACTION_BLOCK  = "block"
+	FINGERPRINT_ACTION_TARPIT = "tarpit"
+)
+
+// FingerprintRoute sends TLS clients with any of the JA3, JA4 or QUIC fingerprints to Backend instead.
+// A nil Backend means the connection is dropped.
+type FingerprintRoute struct {
+	JA3     []string
+	JA4     []string
+	QUIC    []string
+	Backend *BackendInfo
+}
+
+type fingerprintRouteEncoded struct {
+	JA3                []string `yaml:"ja3"`
+	JA4                []string `yaml:"ja4"`
+	QUIC               []string `yaml:"quic"`
+	Action             string   `yaml:"action"`
+	backendInfoEncoded `yaml:",inline"`
+}
+
+func (r *FingerprintRoute) matches(req *Request) bool {
+	return (req.JA3 != "" && slices.Contains(r.JA3, req.JA3)) ||
+		(req.JA4 != "" && slices.Contains(r.JA4, req.JA4)) ||
+		(req.QUICFingerprint != "" && slices.Contains(r.QUIC, req.QUICFingerprint))
+}
+
+func loadFingerprintRoutes(match string, protocol BackendProtocol, cfgs []*backendInfoEncoded) []*FingerprintRoute {
+	var rules []*fingerprintRouteEncoded
+	for _, cfg := range cfgs {
+		if cfg != nil && cfg.Fingerprints != nil {
+			rules = cfg.Fingerprints
+			break
+		}
+	}
+
+	routes := make([]*FingerprintRoute, 0, len(rules))
+	for _, rule := range rules {
+		if len(rule.JA3) == 0 && len(rule.JA4) == 0 && len(rule.QUIC) == 0 {
+			fatalf("No fingerprints specified for fingerprint route of backend %s", match)
+			return nil
+		}
+
+		route := &FingerprintRoute{
+			JA3:  rule.JA3,
+			JA4:  rule.JA4,
+			QUIC: rule.QUIC,
+		}
+		switch rule.Action {
+		case FINGERPRINT_ACTION_ROUTE:
+			route.Backend = loadRouteBackend(match, protocol, &rule.backendInfoEncoded, cfgs)
+		case FINGERPRINT_ACTION_BLOCK:
+			route.Backend = &BackendInfo{Match: match, Block: true, drainKey: FINGERPRINT_ACTION_BLOCK}
+		case FINGERPRINT_ACTION_TARPIT:
+			route.Backend = &BackendInfo{Match: match, Tarpit: true, drainKey: FINGERPRINT_ACTION_TARPIT}
+		default:
+			fatalf("Invalid action %q specified for fingerprint route of backend %s", rule.Action, match)
+			return nil
+		}
+		routes = append(routes, route)
+	}
+	return routes
+}
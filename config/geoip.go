@@ -0,0 +1,95 @@
+package config
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/Doridian/foxIngress/util/geoip"
+)
+
+var geoCountryDatabase *geoip.Database
+var geoASNDatabase *geoip.Database
+var geoMetrics bool
+
+type geoIPEncoded struct {
+	CountryDatabase string `yaml:"country_database"`
+	ASNDatabase     string `yaml:"asn_database"`
+	Metrics         bool   `yaml:"metrics"`
+}
+
+func loadGeoIP(cfg geoIPEncoded) {
+	var err error
+	if cfg.CountryDatabase != "" {
+		geoCountryDatabase, err = geoip.Open(cfg.CountryDatabase)
+		if err != nil {
+			fatalf("Could not open GeoIP country database: %v", err)
+		}
+	}
+
+	if cfg.ASNDatabase == cfg.CountryDatabase {
+		// Some databases contain both
+		geoASNDatabase = geoCountryDatabase
+	} else if cfg.ASNDatabase != "" {
+		geoASNDatabase, err = geoip.Open(cfg.ASNDatabase)
+		if err != nil {
+			fatalf("Could not open GeoIP ASN database: %v", err)
+		}
+	}
+
+	geoMetrics = cfg.Metrics && (geoCountryDatabase != nil || geoASNDatabase != nil)
+}
+
+// LookupGeoIP returns the country and ASN of addr from the configured databases
+func LookupGeoIP(addr netip.Addr) geoip.Info {
+	return geoip.Info{
+		Country: geoCountryDatabase.Lookup(addr).Country,
+		ASN:     geoASNDatabase.Lookup(addr).ASN,
+	}
+}
+
+// GeoIPMetricsEnabled returns whether connections should be counted by country and ASN
+func GeoIPMetricsEnabled() bool {
+	return geoMetrics
+}
+
+func loadCountries(name string, countries []string) []string {
+	if len(countries) == 0 {
+		return nil
+	}
+	if geoCountryDatabase == nil {
+		fatalf("Country rules specified for %s without a GeoIP country database", name)
+		return nil
+	}
+
+	codes := make([]string, 0, len(countries))
+	for _, country := range countries {
+		if len(country) != 2 {
+			fatalf("Invalid country code %q specified for %s", country, name)
+			return nil
+		}
+		codes = append(codes, strings.ToUpper(country))
+	}
+	return codes
+}
+
+func loadASNs(name string, asns []uint) []uint {
+	if len(asns) == 0 {
+		return nil
+	}
+	if geoASNDatabase == nil {
+		fatalf("ASN rules specified for %s without a GeoIP ASN database", name)
+		return nil
+	}
+	return asns
+}
+
+func (b *BackendInfo) geoDenies(req *Request) bool {
+	return (req.Country != "" && slices.Contains(b.DenyCountries, req.Country)) ||
+		(req.ASN != 0 && slices.Contains(b.DenyASNs, req.ASN))
+}
+
+func (b *BackendInfo) geoAllows(req *Request) bool {
+	return (req.Country != "" && slices.Contains(b.AllowCountries, req.Country)) ||
+		(req.ASN != 0 && slices.Contains(b.AllowASNs, req.ASN))
+}
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"net"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// DefaultBackendCheckTimeout is how long /readyz waits for backends to accept a connection by default
+const DefaultBackendCheckTimeout = 2 * time.Second
+
+// HealthConfig controls the checks of the health endpoints
+type HealthConfig struct {
+	// RequireBackend makes /readyz fail unless at least one TCP backend accepts a connection within BackendTimeout
+	RequireBackend bool
+	BackendTimeout time.Duration
+}
+
+var healthConfig *HealthConfig
+
+type healthEncoded struct {
+	RequireBackend bool           `yaml:"require_backend"`
+	BackendTimeout *time.Duration `yaml:"backend_timeout"`
+}
+
+func loadHealthConfig(cfg healthEncoded) *HealthConfig {
+	healthCfg := &HealthConfig{
+		RequireBackend: cfg.RequireBackend,
+		BackendTimeout: DefaultBackendCheckTimeout,
+	}
+	if cfg.BackendTimeout != nil {
+		if *cfg.BackendTimeout <= 0 {
+			fatalf("Invalid health check backend timeout %v specified", *cfg.BackendTimeout)
+			return nil
+		}
+		healthCfg.BackendTimeout = *cfg.BackendTimeout
+	}
+	return healthCfg
+}
+
+// GetHealthConfig returns the config of the health endpoints
+func GetHealthConfig() *HealthConfig {
+	return healthConfig
+}
+
+// GetTCPBackendAddrs returns the addresses of all HTTP and HTTPS backends of host entries, without duplicates
+func GetTCPBackendAddrs() []string {
+	table := routing.Load()
+
+	var addrs []string
+	for _, backends := range []map[string]*BackendInfo{table.http, table.https} {
+		for _, backend := range backends {
+			if backend.Host == "" || backend.Port == 0 {
+				continue
+			}
+			addr := net.JoinHostPort(backend.Host, strconv.Itoa(backend.Port))
+			if !slices.Contains(addrs, addr) {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	slices.Sort(addrs)
+	return addrs
+}
@@ -0,0 +1,206 @@
+package config
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/Doridian/foxIngress/util/limit"
+)
+
+const defaultIPv6LimitPrefix = 64
+
+var clientLimiter atomic.Pointer[limit.Limiter]
+
+type limitsEncoded struct {
+	// Rate is the number of new connections (or QUIC flows) per second a client may open, with bursts of up to Burst
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+	// MaxConcurrent is the number of connections a client may have open at the same time
+	MaxConcurrent int `yaml:"max_concurrent"`
+	// IPv6Prefix is the prefix length IPv6 clients are grouped by
+	IPv6Prefix *int `yaml:"ipv6_prefix"`
+}
+
+func loadLimiter(name string, cfg *limitsEncoded) *limit.Limiter {
+	if cfg == nil {
+		return nil
+	}
+
+	if cfg.Rate < 0 || cfg.Burst < 0 || cfg.MaxConcurrent < 0 {
+		fatalf("Negative limits specified for %s", name)
+		return nil
+	}
+	if cfg.Rate == 0 && cfg.MaxConcurrent == 0 {
+		return nil
+	}
+
+	ipv6Prefix := defaultIPv6LimitPrefix
+	if cfg.IPv6Prefix != nil {
+		ipv6Prefix = *cfg.IPv6Prefix
+	}
+	if ipv6Prefix <= 0 || ipv6Prefix > 128 {
+		fatalf("Invalid IPv6 prefix length %d specified in limits for %s", ipv6Prefix, name)
+		return nil
+	}
+
+	return limit.New(cfg.Rate, cfg.Burst, cfg.MaxConcurrent, ipv6Prefix)
+}
+
+func loadSemaphore(name string, maxConnections *int, queueTimeout *time.Duration) *limit.Semaphore {
+	if maxConnections == nil || *maxConnections == 0 {
+		return nil
+	}
+	if *maxConnections < 0 {
+		fatalf("Negative max_connections specified for %s", name)
+		return nil
+	}
+
+	timeout := time.Duration(0)
+	if queueTimeout != nil {
+		timeout = *queueTimeout
+	}
+	if timeout < 0 {
+		fatalf("Negative queue_timeout specified for %s", name)
+		return nil
+	}
+	return limit.NewSemaphore(*maxConnections, timeout)
+}
+
+// keepLimiter returns old if it has the same settings as new, so open connections stay counted across reloads
+func keepLimiter(old *limit.Limiter, new *limit.Limiter) *limit.Limiter {
+	if old.SameSettings(new) {
+		return old
+	}
+	return new
+}
+
+func keepSemaphore(old *limit.Semaphore, new *limit.Semaphore) *limit.Semaphore {
+	if old.SameSettings(new) {
+		return old
+	}
+	return new
+}
+
+// forEachBackend calls fn for every backend in backends and every backend of their rules
+func forEachBackend(backends map[string]*BackendInfo, fn func(backend *BackendInfo)) {
+	var walk func(backend *BackendInfo)
+	walk = func(backend *BackendInfo) {
+		if backend == nil {
+			return
+		}
+		fn(backend)
+		for _, route := range backend.SourceRoutes {
+			walk(route.Backend)
+		}
+		for _, route := range backend.ALPNRoutes {
+			walk(route.Backend)
+		}
+		for _, route := range backend.PathRoutes {
+			walk(route.Backend)
+		}
+		for _, route := range backend.FingerprintRoutes {
+			walk(route.Backend)
+		}
+	}
+	for _, backend := range backends {
+		walk(backend)
+	}
+}
+
+// forEachSlotsBackend calls fn for every backend which connections are dialed to, along with the key of its semaphore
+func (t *routingTable) forEachSlotsBackend(fn func(key string, backend *BackendInfo)) {
+	networks := map[string][]map[string]*BackendInfo{
+		"tcp": {t.http, t.https, t.acmeHttp, t.acmeTls},
+		"udp": {t.quic},
+	}
+	for network, tables := range networks {
+		for _, backends := range tables {
+			forEachBackend(backends, func(backend *BackendInfo) {
+				if backend.Host != "" {
+					fn(network+"/"+backend.drainKey, backend)
+				}
+			})
+		}
+	}
+}
+
+// shareBackendSlots makes all host entries and rules using the same backend share one semaphore,
+// so max_connections limits the connections to the backend no matter which host they are for
+func shareBackendSlots(table *routingTable) {
+	table.slots = make(map[string]*limit.Semaphore)
+	table.forEachSlotsBackend(func(key string, backend *BackendInfo) {
+		if backend.Slots == nil {
+			return
+		}
+		slots, ok := table.slots[key]
+		if !ok {
+			table.slots[key] = backend.Slots
+			return
+		}
+		if !slots.SameSettings(backend.Slots) {
+			fatalf("Different max_connections or queue_timeout specified for backend %s", backend.drainKey)
+		}
+	})
+	table.assignSlots()
+}
+
+func (t *routingTable) assignSlots() {
+	t.forEachSlotsBackend(func(key string, backend *BackendInfo) {
+		backend.Slots = t.slots[key]
+	})
+}
+
+// keepBackendLimits moves the limiters of the old backends over to the backends of the same host entries (and rules
+// at the same position) in the new routing table, and the semaphores over to the same backends, as long as their
+// settings did not change
+func keepBackendLimits(old *routingTable, new *routingTable) {
+	for key, slots := range new.slots {
+		new.slots[key] = keepSemaphore(old.slots[key], slots)
+	}
+	new.assignSlots()
+
+	pairs := [][2]map[string]*BackendInfo{
+		{old.http, new.http},
+		{old.https, new.https},
+		{old.quic, new.quic},
+		{old.acmeHttp, new.acmeHttp},
+		{old.acmeTls, new.acmeTls},
+	}
+	for _, pair := range pairs {
+		for match, newBackend := range pair[1] {
+			oldBackend, ok := pair[0][match]
+			if ok {
+				keepLimits(oldBackend, newBackend)
+			}
+		}
+	}
+}
+
+func keepLimits(old *BackendInfo, new *BackendInfo) {
+	if old == nil || new == nil {
+		return
+	}
+	new.Limiter = keepLimiter(old.Limiter, new.Limiter)
+	if new.Host == "" {
+		// Redirects are not dialed, so their semaphores belong to their host entry
+		new.Slots = keepSemaphore(old.Slots, new.Slots)
+	}
+
+	for i := range min(len(old.SourceRoutes), len(new.SourceRoutes)) {
+		keepLimits(old.SourceRoutes[i].Backend, new.SourceRoutes[i].Backend)
+	}
+	for i := range min(len(old.ALPNRoutes), len(new.ALPNRoutes)) {
+		keepLimits(old.ALPNRoutes[i].Backend, new.ALPNRoutes[i].Backend)
+	}
+	for i := range min(len(old.PathRoutes), len(new.PathRoutes)) {
+		keepLimits(old.PathRoutes[i].Backend, new.PathRoutes[i].Backend)
+	}
+	for i := range min(len(old.FingerprintRoutes), len(new.FingerprintRoutes)) {
+		keepLimits(old.FingerprintRoutes[i].Backend, new.FingerprintRoutes[i].Backend)
+	}
+}
+
+// GetClientLimiter returns the limiter for all connections, which is checked before sniffing them (nil if not configured)
+func GetClientLimiter() *limit.Limiter {
+	return clientLimiter.Load()
+}
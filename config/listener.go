@@ -0,0 +1,115 @@
+package config
+
+import (
+	"errors"
+	"net/netip"
+	"time"
+
+	"github.com/Doridian/foxIngress/util/limit"
+
+	"gopkg.in/yaml.v3"
+)
+
+var listenerHttp *ListenerConfig
+var listenerHttps *ListenerConfig
+var listenerQuic *ListenerConfig
+
+// DefaultSniffTimeout is how long clients have to send their PROXY protocol header, ClientHello or HTTP request headers by default
+const DefaultSniffTimeout = 10 * time.Second
+
+const (
+	INTERCEPT_NONE     = ""
+	INTERCEPT_TPROXY   = "tproxy"
+	INTERCEPT_REDIRECT = "redirect"
+)
+
+// ListenerConfig holds the address and options of a listener
+type ListenerConfig struct {
+	Addr string
+
+	// AcceptProxyProtocol makes the listener expect PROXY protocol headers from TrustedProxies
+	AcceptProxyProtocol bool
+	TrustedProxies      []netip.Prefix
+
+	// Intercept makes the listener accept traffic for other addresses (redirected to it by the firewall)
+	// and route it by its original destination if the client sent no hostname
+	Intercept string
+
+	// Slots limits the connections open on the listener (nil if not configured)
+	Slots *limit.Semaphore
+
+	// SniffTimeout and MaxSniffSize limit how long and how much we read from a TCP client before it is routed (0 for no limit)
+	SniffTimeout time.Duration
+	MaxSniffSize int
+}
+
+type listenerConfigEncoded struct {
+	Addr                string         `yaml:"addr"`
+	AcceptProxyProtocol bool           `yaml:"accept_proxy_protocol"`
+	TrustedProxies      []string       `yaml:"trusted_proxies"`
+	Intercept           string         `yaml:"intercept"`
+	MaxConnections      *int           `yaml:"max_connections"`
+	QueueTimeout        *time.Duration `yaml:"queue_timeout"`
+	SniffTimeout        *time.Duration `yaml:"sniff_timeout"`
+	MaxSniffSize        int            `yaml:"max_sniff_size"`
+}
+
+// UnmarshalYAML accepts either just an address or a full listener config
+func (l *listenerConfigEncoded) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&l.Addr)
+	}
+
+	type plain listenerConfigEncoded
+	return value.Decode((*plain)(l))
+}
+
+func (l *ListenerConfig) TrustsProxy(addr netip.Addr) bool {
+	return prefixesContain(l.TrustedProxies, addr.Unmap())
+}
+
+func loadListenerConfig(name string, cfg listenerConfigEncoded) *ListenerConfig {
+	switch cfg.Intercept {
+	case INTERCEPT_NONE, INTERCEPT_TPROXY, INTERCEPT_REDIRECT:
+	default:
+		fatalf("Invalid intercept mode %q for listener %s", cfg.Intercept, name)
+	}
+	if cfg.Intercept != INTERCEPT_NONE && name == "quic" {
+		fatalf("Intercepting traffic is not supported for listener %s", name)
+	}
+
+	// Trusting everyone would let any client spoof its address past bans, limits and source rules
+	if cfg.AcceptProxyProtocol && len(cfg.TrustedProxies) == 0 {
+		fatalf("Listener %s accepts the PROXY protocol but has no trusted_proxies", name)
+	}
+
+	sniffTimeout := DefaultSniffTimeout
+	if cfg.SniffTimeout != nil {
+		sniffTimeout = *cfg.SniffTimeout
+	}
+	if sniffTimeout < 0 || cfg.MaxSniffSize < 0 {
+		fatalf("Negative sniff_timeout or max_sniff_size for listener %s", name)
+	}
+
+	return &ListenerConfig{
+		Addr:                cfg.Addr,
+		AcceptProxyProtocol: cfg.AcceptProxyProtocol,
+		TrustedProxies:      loadPrefixes("listener "+name, cfg.TrustedProxies),
+		Intercept:           cfg.Intercept,
+		Slots:               loadSemaphore("listener "+name, cfg.MaxConnections, cfg.QueueTimeout),
+		SniffTimeout:        sniffTimeout,
+		MaxSniffSize:        cfg.MaxSniffSize,
+	}
+}
+
+func GetListenerConfig(protocol BackendProtocol) (*ListenerConfig, error) {
+	switch protocol {
+	case PROTO_HTTP:
+		return listenerHttp, nil
+	case PROTO_HTTPS:
+		return listenerHttps, nil
+	case PROTO_QUIC:
+		return listenerQuic, nil
+	}
+	return nil, errors.New("invalid protocol")
+}
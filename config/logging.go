@@ -0,0 +1,70 @@
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/Doridian/foxIngress/util/logging"
+)
+
+var logger = logging.New("config")
+
+type loggingEncoded struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+}
+
+// configError is raised by fatalf while loading the config
+type configError struct {
+	msg string
+}
+
+func (e configError) Error() string {
+	return e.msg
+}
+
+// fatalf aborts loading the config, which exits on startup and keeps the old config on reload
+func fatalf(format string, args ...any) {
+	panic(configError{msg: fmt.Sprintf(format, args...)})
+}
+
+func catchConfigError(load func()) (err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		cfgErr, ok := r.(configError)
+		if !ok {
+			panic(r)
+		}
+		err = cfgErr
+	}()
+
+	load()
+	return nil
+}
+
+func loadLogging(cfg loggingEncoded) {
+	lvl := slog.LevelInfo
+	if cfg.Level != "" {
+		var err error
+		lvl, err = logging.ParseLevel(cfg.Level)
+		if err != nil {
+			fatalf("Invalid log level %s", cfg.Level)
+		}
+	} else if os.Getenv("VERBOSE") != "" {
+		lvl = slog.LevelDebug
+	}
+
+	format := cfg.Format
+	if format == "" {
+		format = logging.FORMAT_TEXT
+	}
+
+	err := logging.Configure(lvl, format)
+	if err != nil {
+		fatalf("Could not configure logging: %v", err)
+	}
+}
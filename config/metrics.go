@@ -0,0 +1,63 @@
+package config
+
+import (
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// metricLabels are the names of all labels of our metrics
+var metricLabels = []string{"proto", "ipproto", "listener", "host", "backend", "reason", "direction", "country", "asn"}
+
+// MetricsConfig controls the cardinality of metric labels
+type MetricsConfig struct {
+	// Labels are the labels emitted, all others are left empty
+	Labels map[string]bool
+	// CollapseWildcards labels connections matched by a wildcard host with the pattern instead of their hostname
+	CollapseWildcards bool
+	// MaxLabelValues is the number of distinct values per label, further values are replaced by "other" (0 for no limit)
+	MaxLabelValues int
+}
+
+var metricsConfig atomic.Pointer[MetricsConfig]
+
+type metricsEncoded struct {
+	Labels            []string `yaml:"labels"`
+	CollapseWildcards *bool    `yaml:"collapse_wildcards"`
+	MaxLabelValues    int      `yaml:"max_label_values"`
+}
+
+func loadMetricsConfig(cfg metricsEncoded) *MetricsConfig {
+	metricsCfg := &MetricsConfig{
+		Labels:            make(map[string]bool),
+		CollapseWildcards: true,
+		MaxLabelValues:    cfg.MaxLabelValues,
+	}
+
+	if cfg.Labels == nil {
+		for _, label := range metricLabels {
+			metricsCfg.Labels[label] = true
+		}
+	}
+	for _, label := range cfg.Labels {
+		label = strings.ToLower(label)
+		if !slices.Contains(metricLabels, label) {
+			fatalf("Invalid metric label %s specified", label)
+			return nil
+		}
+		metricsCfg.Labels[label] = true
+	}
+
+	if cfg.CollapseWildcards != nil {
+		metricsCfg.CollapseWildcards = *cfg.CollapseWildcards
+	}
+	if metricsCfg.MaxLabelValues < 0 {
+		fatalf("Invalid maximum number of metric label values %d specified", metricsCfg.MaxLabelValues)
+		return nil
+	}
+	return metricsCfg
+}
+
+func GetMetricsConfig() *MetricsConfig {
+	return metricsConfig.Load()
+}
@@ -0,0 +1,300 @@
+package config
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+const acmeChallengePathPrefix = "/.well-known/acme-challenge/"
+const acmeTLSALPN = "acme-tls/1"
+
+// ErrDenied is returned by Route along with the matched backend if the client is not allowed to use it (or blocked by its fingerprint)
+var ErrDenied = errors.New("access denied")
+
+// Request holds everything sniffed from a client that can influence which backend it is routed to
+type Request struct {
+	Protocol BackendProtocol
+	Hostname string
+	Source   netip.Addr
+	// Country and ASN of Source, filled in by Route if GeoIP databases are configured
+	Country string
+	ASN     uint
+
+	// Destination is the original destination of intercepted traffic, used for routing if Hostname is empty
+	Destination netip.Addr
+
+	// Path is the path of the first request on a plaintext HTTP connection
+	Path string
+	// ALPN is the list of protocols offered in a TLS ClientHello
+	ALPN []string
+	// JA3 and JA4 are the fingerprints of the TLS ClientHello, QUICFingerprint the one of the QUIC transport parameters
+	JA3             string
+	JA4             string
+	QUICFingerprint string
+}
+
+// SourceRoute sends clients with a source address within any of CIDRs to Backend instead.
+// A nil Backend means the connection is dropped.
+type SourceRoute struct {
+	CIDRs   []netip.Prefix
+	Backend *BackendInfo
+}
+
+type sourceRouteEncoded struct {
+	CIDRs              []string `yaml:"cidrs"`
+	backendInfoEncoded `yaml:",inline"`
+}
+
+// ALPNRoute sends clients offering any of Protocols to Backend instead.
+// A nil Backend means the connection is dropped.
+type ALPNRoute struct {
+	Protocols []string
+	Backend   *BackendInfo
+}
+
+type alpnRouteEncoded struct {
+	Protocols          []string `yaml:"protocols"`
+	backendInfoEncoded `yaml:",inline"`
+}
+
+// PathRoute sends plaintext HTTP clients whose first request path starts with Prefix to Backend instead.
+// A nil Backend means the connection is dropped.
+type PathRoute struct {
+	Prefix  string
+	Backend *BackendInfo
+}
+
+type pathRouteEncoded struct {
+	Prefix             string `yaml:"prefix"`
+	backendInfoEncoded `yaml:",inline"`
+}
+
+func prefixesContain(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *SourceRoute) matches(source netip.Addr) bool {
+	return prefixesContain(r.CIDRs, source)
+}
+
+func (r *ALPNRoute) matches(alpn []string) bool {
+	for _, proto := range alpn {
+		if slices.Contains(r.Protocols, proto) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadRouteBackend loads the backend of a routing rule, which inherits all unset values from the backend it belongs to
+func loadRouteBackend(match string, protocol BackendProtocol, rule *backendInfoEncoded, cfgs []*backendInfoEncoded) *BackendInfo {
+	return loadSingleBackendConfig(match, protocol, append([]*backendInfoEncoded{rule}, cfgs...)...)
+}
+
+func loadPrefixes(name string, cidrs []string) []netip.Prefix {
+	if len(cidrs) == 0 {
+		return nil
+	}
+
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		var prefix netip.Prefix
+		var err error
+		if strings.Contains(cidr, "/") {
+			prefix, err = netip.ParsePrefix(cidr)
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(cidr)
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			fatalf("Invalid CIDR %q specified for %s: %v", cidr, name, err)
+			return nil
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes
+}
+
+func loadSourceRoutes(match string, protocol BackendProtocol, cfgs []*backendInfoEncoded) []*SourceRoute {
+	var rules []*sourceRouteEncoded
+	for _, cfg := range cfgs {
+		if cfg != nil && cfg.SourceRoutes != nil {
+			rules = cfg.SourceRoutes
+			break
+		}
+	}
+
+	routes := make([]*SourceRoute, 0, len(rules))
+	for _, rule := range rules {
+		if len(rule.CIDRs) == 0 {
+			fatalf("No CIDRs specified for source route of backend %s", match)
+			return nil
+		}
+
+		routes = append(routes, &SourceRoute{
+			CIDRs:   loadPrefixes("source route of backend "+match, rule.CIDRs),
+			Backend: loadRouteBackend(match, protocol, &rule.backendInfoEncoded, cfgs),
+		})
+	}
+	return routes
+}
+
+func loadALPNRoutes(match string, protocol BackendProtocol, cfgs []*backendInfoEncoded) []*ALPNRoute {
+	var rules []*alpnRouteEncoded
+	for _, cfg := range cfgs {
+		if cfg != nil && cfg.ALPN != nil {
+			rules = cfg.ALPN
+			break
+		}
+	}
+
+	routes := make([]*ALPNRoute, 0, len(rules))
+	for _, rule := range rules {
+		if len(rule.Protocols) == 0 {
+			fatalf("No protocols specified for ALPN route of backend %s", match)
+			return nil
+		}
+
+		routes = append(routes, &ALPNRoute{
+			Protocols: rule.Protocols,
+			Backend:   loadRouteBackend(match, protocol, &rule.backendInfoEncoded, cfgs),
+		})
+	}
+	return routes
+}
+
+func loadPathRoutes(match string, protocol BackendProtocol, cfgs []*backendInfoEncoded) []*PathRoute {
+	var rules []*pathRouteEncoded
+	for _, cfg := range cfgs {
+		if cfg != nil && cfg.Paths != nil {
+			rules = cfg.Paths
+			break
+		}
+	}
+
+	routes := make([]*PathRoute, 0, len(rules))
+	for _, rule := range rules {
+		if !strings.HasPrefix(rule.Prefix, "/") {
+			fatalf("Invalid path prefix %q specified for path route of backend %s", rule.Prefix, match)
+			return nil
+		}
+
+		routes = append(routes, &PathRoute{
+			Prefix:  rule.Prefix,
+			Backend: loadRouteBackend(match, protocol, &rule.backendInfoEncoded, cfgs),
+		})
+	}
+	return routes
+}
+
+func (r *Request) acmeBackends() map[string]*BackendInfo {
+	switch r.Protocol {
+	case PROTO_HTTP:
+		if strings.HasPrefix(r.Path, acmeChallengePathPrefix) {
+			return routing.Load().acmeHttp
+		}
+	case PROTO_HTTPS:
+		if slices.Contains(r.ALPN, acmeTLSALPN) {
+			return routing.Load().acmeTls
+		}
+	}
+	return nil
+}
+
+// Allows checks the allow and deny lists (of CIDRs, countries and ASNs) of the backend, deny taking precedence.
+// A client matching any allow list is allowed, if all allow lists are empty everyone not denied is.
+func (b *BackendInfo) Allows(req *Request) bool {
+	source := req.Source.Unmap()
+	if prefixesContain(b.Deny, source) || b.geoDenies(req) {
+		return false
+	}
+	if len(b.Allow) == 0 && len(b.AllowCountries) == 0 && len(b.AllowASNs) == 0 {
+		return true
+	}
+	return prefixesContain(b.Allow, source) || b.geoAllows(req)
+}
+
+func (b *BackendInfo) route(req *Request) *BackendInfo {
+	for _, fingerprintRoute := range b.FingerprintRoutes {
+		if fingerprintRoute.matches(req) {
+			return fingerprintRoute.Backend
+		}
+	}
+	for _, sourceRoute := range b.SourceRoutes {
+		if sourceRoute.matches(req.Source.Unmap()) {
+			return sourceRoute.Backend
+		}
+	}
+	for _, pathRoute := range b.PathRoutes {
+		if strings.HasPrefix(req.Path, pathRoute.Prefix) {
+			return pathRoute.Backend
+		}
+	}
+	for _, alpnRoute := range b.ALPNRoutes {
+		if alpnRoute.matches(req.ALPN) {
+			return alpnRoute.Backend
+		}
+	}
+	return b
+}
+
+func Route(req *Request) (*BackendInfo, error) {
+	if req.Country == "" && req.ASN == 0 {
+		info := LookupGeoIP(req.Source)
+		req.Country = info.Country
+		req.ASN = info.ASN
+	}
+
+	backend, err := routeUnchecked(req)
+	if err != nil || backend == nil {
+		return backend, err
+	}
+
+	if backend.Block || !backend.Allows(req) {
+		return backend, ErrDenied
+	}
+	if backend.Draining() {
+		return backend, ErrDraining
+	}
+	return backend, nil
+}
+
+func routeUnchecked(req *Request) (*BackendInfo, error) {
+	acmeBackends := req.acmeBackends()
+	if acmeBackends != nil {
+		backend := req.findBackend(acmeBackends)
+		if backend != nil {
+			return backend, nil
+		}
+	}
+
+	backends, err := getBackends(req.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	backend := req.findBackend(backends)
+	if backend == nil {
+		return nil, nil
+	}
+	return backend.route(req), nil
+}
+
+// findBackend looks up the hostname of the request, falling back to its destination address (if any) and then the default backend
+func (req *Request) findBackend(backends map[string]*BackendInfo) *BackendInfo {
+	if req.Hostname == "" && req.Destination.IsValid() {
+		backend, ok := backends[req.Destination.Unmap().String()]
+		if ok {
+			return backend
+		}
+	}
+	backend, _ := findBackend(req.Hostname, backends)
+	return backend
+}
@@ -0,0 +1,20 @@
+package conn
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/Doridian/foxIngress/config"
+	"github.com/Doridian/foxIngress/util/ban"
+)
+
+// RecordBanEvent counts event towards banning the client at addr
+func RecordBanEvent(addr netip.Addr, event ban.Event) {
+	newBan := config.GetBans().Record(addr, event)
+	if newBan == nil {
+		return
+	}
+
+	BansTotal.WithLabelValues(newBan.Reason).Inc()
+	logger.Info("Banned client", "prefix", newBan.Prefix.String(), "until", newBan.Until.Format(time.RFC3339), "reason", newBan.Reason)
+}
@@ -1,16 +1,31 @@
 package conn
 
 import (
+	"github.com/Doridian/foxIngress/util/logging"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+var logger = logging.New("proxy")
+
 type Listener interface {
 	Start()
 	IPProto() string
 }
 
-var RawConnectionsTotal = promauto.NewCounterVec(
+// Reasons of FailuresTotal
+const (
+	FailureIntercept        = "intercept"
+	FailureProxyHeaderRead  = "proxy_header_read"
+	FailureDecode           = "decode"
+	FailureClientHello      = "client_hello"
+	FailureRoute            = "route"
+	FailureNoBackend        = "no_backend"
+	FailureDraining         = "draining"
+	FailureDial             = "dial"
+	FailureProxyHeaderWrite = "proxy_header_write"
+)
+
+var RawConnectionsTotal = newCounterVec(
 	prometheus.CounterOpts{
 		Name: "foxingress_raw_connections_total",
 		Help: "Total number of connections accepted by a listener",
@@ -18,7 +33,7 @@ var RawConnectionsTotal = promauto.NewCounterVec(
 	[]string{"proto", "ipproto", "listener"},
 )
 
-var OpenConnections = promauto.NewGaugeVec(
+var OpenConnections = newGaugeVec(
 	prometheus.GaugeOpts{
 		Name: "foxingress_open_connections",
 		Help: "Number of open connections",
@@ -26,10 +41,117 @@ var OpenConnections = promauto.NewGaugeVec(
 	[]string{"proto", "ipproto", "listener", "host", "backend"},
 )
 
-var ConnectionsTotal = promauto.NewCounterVec(
+var ConnectionsTotal = newCounterVec(
 	prometheus.CounterOpts{
 		Name: "foxingress_connections_total",
 		Help: "Total number of connections",
 	},
 	[]string{"proto", "ipproto", "listener", "host", "backend"},
 )
+
+var BytesTotal = newCounterVec(
+	prometheus.CounterOpts{
+		Name: "foxingress_bytes_total",
+		Help: "Total number of payload bytes proxied, in from clients to backends and out from backends to clients",
+	},
+	[]string{"proto", "ipproto", "listener", "host", "backend", "direction"},
+)
+
+var PacketsTotal = newCounterVec(
+	prometheus.CounterOpts{
+		Name: "foxingress_packets_total",
+		Help: "Total number of datagrams proxied (UDP only), in from clients to backends and out from backends to clients",
+	},
+	[]string{"proto", "ipproto", "listener", "host", "backend", "direction"},
+)
+
+var DroppedPacketsTotal = newCounterVec(
+	prometheus.CounterOpts{
+		Name: "foxingress_dropped_packets_total",
+		Help: "Total number of datagrams from clients dropped because their flow was not ready for them (UDP only)",
+	},
+	[]string{"proto", "ipproto", "listener"},
+)
+
+var ConnectionDuration = newHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "foxingress_connection_duration_seconds",
+		Help:    "Duration of proxied connections (for UDP including the idle timeout)",
+		Buckets: []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600, 14400},
+	},
+	[]string{"proto", "ipproto", "listener", "host", "backend"},
+)
+
+var GeoConnectionsTotal = newCounterVec(
+	prometheus.CounterOpts{
+		Name: "foxingress_geo_connections_total",
+		Help: "Total number of connections by client country and ASN (only if enabled in the GeoIP config)",
+	},
+	[]string{"proto", "ipproto", "listener", "host", "country", "asn"},
+)
+
+var DeniedConnectionsTotal = newCounterVec(
+	prometheus.CounterOpts{
+		Name: "foxingress_denied_connections_total",
+		Help: "Total number of connections denied by a backend's source address, country or ASN rules",
+	},
+	[]string{"proto", "ipproto", "listener", "host"},
+)
+
+var LimitedConnectionsTotal = newCounterVec(
+	prometheus.CounterOpts{
+		Name: "foxingress_limited_connections_total",
+		Help: "Total number of connections rejected by per-client rate or concurrency limits or maximum connection counts (host is empty for global and listener limits)",
+	},
+	[]string{"proto", "ipproto", "listener", "host", "reason"},
+)
+
+var SniffTimeoutsTotal = newCounterVec(
+	prometheus.CounterOpts{
+		Name: "foxingress_sniff_timeouts_total",
+		Help: "Total number of connections closed because the client did not send enough data to route them in time",
+	},
+	[]string{"proto", "ipproto", "listener"},
+)
+
+var FailuresTotal = newCounterVec(
+	prometheus.CounterOpts{
+		Name: "foxingress_failures_total",
+		Help: "Total number of connections failing, by reason (backend is empty for failures before routing)",
+	},
+	[]string{"proto", "ipproto", "listener", "backend", "reason"},
+)
+
+var DialDuration = newHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "foxingress_dial_duration_seconds",
+		Help:    "Duration of successful dials to backends",
+		Buckets: prometheus.DefBuckets,
+	},
+	[]string{"proto", "ipproto", "listener", "host", "backend"},
+)
+
+var SniffDuration = newHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "foxingress_sniff_duration_seconds",
+		Help:    "Time taken to receive and decode the ClientHello or request headers of connections (TCP only)",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	},
+	[]string{"proto", "ipproto", "listener"},
+)
+
+var BannedTotal = newCounterVec(
+	prometheus.CounterOpts{
+		Name: "foxingress_banned_total",
+		Help: "Total number of connections (TCP) or datagrams (UDP) dropped because the client is banned",
+	},
+	[]string{"proto", "ipproto", "listener"},
+)
+
+var BansTotal = newCounterVec(
+	prometheus.CounterOpts{
+		Name: "foxingress_bans_total",
+		Help: "Total number of clients banned automatically",
+	},
+	[]string{"reason"},
+)
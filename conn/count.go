@@ -0,0 +1,31 @@
+package conn
+
+import (
+	"io"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TrafficCounter counts the bytes of one direction of a connection in a metric and a total
+type TrafficCounter struct {
+	Metric prometheus.Counter
+	Total  *atomic.Int64
+}
+
+func (c TrafficCounter) Add(n int) {
+	c.Metric.Add(float64(n))
+	c.Total.Add(int64(n))
+}
+
+// CountingWriter counts the bytes written through it
+type CountingWriter struct {
+	Writer  io.Writer
+	Counter TrafficCounter
+}
+
+func (w *CountingWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	w.Counter.Add(n)
+	return n, err
+}
@@ -0,0 +1,31 @@
+package conn
+
+import (
+	"net"
+	"time"
+
+	"github.com/Doridian/foxIngress/config"
+	"github.com/Doridian/foxIngress/util"
+)
+
+var DialTimeout = 10 * time.Second
+
+// NewDialer returns a dialer for connections to backend on behalf of the client at clientAddr
+func NewDialer(backend *config.BackendInfo, clientAddr net.Addr) *net.Dialer {
+	dialer := &net.Dialer{
+		Timeout: DialTimeout,
+	}
+
+	if backend.Transparent {
+		// Connect from the client's address, with the kernel choosing the port
+		dialer.Control = util.TransparentControl
+		switch addr := clientAddr.(type) {
+		case *net.TCPAddr:
+			dialer.LocalAddr = &net.TCPAddr{IP: addr.AddrPort().Addr().Unmap().AsSlice()}
+		case *net.UDPAddr:
+			dialer.LocalAddr = &net.UDPAddr{IP: addr.AddrPort().Addr().Unmap().AsSlice()}
+		}
+	}
+
+	return dialer
+}
@@ -0,0 +1,20 @@
+package conn
+
+import (
+	"strconv"
+
+	"github.com/Doridian/foxIngress/config"
+)
+
+// CountGeoConnection counts a connection routed to host by the client's country and ASN, if enabled
+func CountGeoConnection(proto string, ipproto string, listener string, host string, req *config.Request) {
+	if !config.GeoIPMetricsEnabled() {
+		return
+	}
+
+	asn := ""
+	if req.ASN != 0 {
+		asn = strconv.FormatUint(uint64(req.ASN), 10)
+	}
+	GeoConnectionsTotal.WithLabelValues(proto, ipproto, listener, host, req.Country, asn).Inc()
+}
@@ -0,0 +1,121 @@
+package conn
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/Doridian/foxIngress/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// LabelOther replaces label values once a label has the maximum number of distinct values
+const LabelOther = "other"
+
+// fixedLabels only have a few values known in advance, so they are not limited
+var fixedLabels = map[string]bool{
+	"proto":     true,
+	"ipproto":   true,
+	"direction": true,
+	"reason":    true,
+}
+
+var labelValuesLock sync.Mutex
+var labelValues = make(map[string]map[string]struct{})
+
+// limitLabels applies the metrics config to the values of labels
+func limitLabels(labels []string, values []string) []string {
+	cfg := config.GetMetricsConfig()
+
+	limited := make([]string, len(values))
+	for i, value := range values {
+		label := labels[i]
+		if cfg.Labels != nil && !cfg.Labels[label] {
+			continue
+		}
+		limited[i] = limitLabelValue(cfg, label, value)
+	}
+	return limited
+}
+
+func limitLabelValue(cfg *config.MetricsConfig, label string, value string) string {
+	if cfg.MaxLabelValues <= 0 || value == "" || fixedLabels[label] {
+		return value
+	}
+
+	labelValuesLock.Lock()
+	defer labelValuesLock.Unlock()
+
+	values, ok := labelValues[label]
+	if !ok {
+		values = make(map[string]struct{})
+		labelValues[label] = values
+	}
+	if _, ok := values[value]; ok {
+		return value
+	}
+	if len(values) >= cfg.MaxLabelValues {
+		return LabelOther
+	}
+	values[value] = struct{}{}
+	return value
+}
+
+// HostLabel is the value of the host label for connections routed to backend for hostname
+func HostLabel(backend *config.BackendInfo, hostname string) string {
+	if !config.GetMetricsConfig().CollapseWildcards && strings.HasPrefix(backend.Match, "_.") {
+		return hostname
+	}
+	return backend.Match
+}
+
+// CounterVec is a prometheus.CounterVec with limited labels
+type CounterVec struct {
+	vec    *prometheus.CounterVec
+	labels []string
+}
+
+func newCounterVec(opts prometheus.CounterOpts, labels []string) *CounterVec {
+	return &CounterVec{
+		vec:    promauto.NewCounterVec(opts, labels),
+		labels: labels,
+	}
+}
+
+func (v *CounterVec) WithLabelValues(values ...string) prometheus.Counter {
+	return v.vec.WithLabelValues(limitLabels(v.labels, values)...)
+}
+
+// GaugeVec is a prometheus.GaugeVec with limited labels
+type GaugeVec struct {
+	vec    *prometheus.GaugeVec
+	labels []string
+}
+
+func newGaugeVec(opts prometheus.GaugeOpts, labels []string) *GaugeVec {
+	return &GaugeVec{
+		vec:    promauto.NewGaugeVec(opts, labels),
+		labels: labels,
+	}
+}
+
+func (v *GaugeVec) WithLabelValues(values ...string) prometheus.Gauge {
+	return v.vec.WithLabelValues(limitLabels(v.labels, values)...)
+}
+
+// HistogramVec is a prometheus.HistogramVec with limited labels
+type HistogramVec struct {
+	vec    *prometheus.HistogramVec
+	labels []string
+}
+
+func newHistogramVec(opts prometheus.HistogramOpts, labels []string) *HistogramVec {
+	return &HistogramVec{
+		vec:    promauto.NewHistogramVec(opts, labels),
+		labels: labels,
+	}
+}
+
+func (v *HistogramVec) WithLabelValues(values ...string) prometheus.Observer {
+	return v.vec.WithLabelValues(limitLabels(v.labels, values)...)
+}
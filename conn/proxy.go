@@ -0,0 +1,40 @@
+package conn
+
+import (
+	"github.com/Doridian/foxIngress/config"
+	"github.com/Doridian/foxIngress/util/proxy"
+)
+
+// ProxyTLVs builds the PROXY protocol v2 TLVs configured for backend
+func ProxyTLVs(backend *config.BackendInfo, req *config.Request, id string) []proxy.TLV {
+	cfg := backend.ProxyProtocolTLVs
+	if cfg == nil {
+		return nil
+	}
+
+	var tlvs []proxy.TLV
+	if cfg.Authority && req.Hostname != "" {
+		tlvs = append(tlvs, proxy.TLV{Type: proxy.TLVTypeAuthority, Value: []byte(req.Hostname)})
+	}
+	// We never see the negotiated protocol, so this is the one the client prefers
+	if cfg.ALPN && len(req.ALPN) > 0 {
+		tlvs = append(tlvs, proxy.TLV{Type: proxy.TLVTypeALPN, Value: []byte(req.ALPN[0])})
+	}
+	if cfg.UniqueID {
+		tlvs = append(tlvs, proxy.TLV{Type: proxy.TLVTypeUniqueID, Value: []byte(id)})
+	}
+	if cfg.JA3 != 0 && req.JA3 != "" {
+		tlvs = append(tlvs, proxy.TLV{Type: cfg.JA3, Value: []byte(req.JA3)})
+	}
+	if cfg.JA4 != 0 && req.JA4 != "" {
+		tlvs = append(tlvs, proxy.TLV{Type: cfg.JA4, Value: []byte(req.JA4)})
+	}
+	for _, tlv := range cfg.Custom {
+		tlvs = append(tlvs, proxy.TLV{Type: tlv.Type, Value: []byte(tlv.Value)})
+	}
+	// The checksum goes last, so it covers all other TLVs
+	if cfg.CRC32C {
+		tlvs = append(tlvs, proxy.TLV{Type: proxy.TLVTypeCRC32C})
+	}
+	return tlvs
+}
@@ -9,12 +9,12 @@ import (
 	"github.com/Doridian/foxIngress/conn/udp"
 )
 
-func GetListenerForProto(host string, proto config.BackendProtocol) (listener conn.Listener, err error) {
+func GetListenerForProto(cfg *config.ListenerConfig, proto config.BackendProtocol) (listener conn.Listener, err error) {
 	switch proto {
 	case config.PROTO_HTTP, config.PROTO_HTTPS:
-		listener, err = tcp.NewListener(host, proto)
+		listener, err = tcp.NewListener(cfg, proto)
 	case config.PROTO_QUIC:
-		listener, err = udp.NewListener(host, proto)
+		listener, err = udp.NewListener(cfg, proto)
 	default:
 		return nil, fmt.Errorf("unknown protocol %v", proto)
 	}
@@ -4,59 +4,248 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"net/netip"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Doridian/foxIngress/config"
 	"github.com/Doridian/foxIngress/conn"
+	"github.com/Doridian/foxIngress/util/accesslog"
+	"github.com/Doridian/foxIngress/util/ban"
+	"github.com/Doridian/foxIngress/util/fingerprint"
+	"github.com/Doridian/foxIngress/util/limit"
+	"github.com/Doridian/foxIngress/util/logging"
 	"github.com/Doridian/foxIngress/util/proxy"
 	"github.com/inconshreveable/go-vhost"
 )
 
 func (l *Listener) handleConnection(client net.Conn) {
 	conn.RawConnectionsTotal.WithLabelValues(l.proto.String(), l.IPProto(), l.listener.Addr().String()).Inc()
+	connID := conn.NewID()
 
 	defer func() {
 		_ = client.Close()
 	}()
 
-	var clientConn vhost.Conn
+	accessLog := config.GetAccessLog()
+	entry := &accesslog.Entry{
+		Time:     time.Now(),
+		ConnID:   connID,
+		Client:   client.RemoteAddr().String(),
+		Listener: l.listener.Addr().String(),
+		Proto:    l.proto.String(),
+	}
+	defer func() {
+		entry.Duration = time.Since(entry.Time)
+		accessLog.Log(entry)
+	}()
+
 	var err error
+	if l.cfg.Intercept != config.INTERCEPT_NONE {
+		interceptedClient, err := l.interceptConn(client)
+		if err != nil {
+			l.countFailure("", conn.FailureIntercept)
+			l.logger.Warn("Error reading original destination", "client", client.RemoteAddr().String(), "conn_id", connID, "error", err)
+			entry.Reason = accesslog.ReasonError
+			return
+		}
+		client = interceptedClient
+	}
+
+	if l.cfg.AcceptProxyProtocol {
+		l.setSniffDeadline(client)
+		proxiedClient, err := l.acceptProxyHeader(client)
+		if err != nil {
+			l.countSniffError(err)
+			l.countFailure("", conn.FailureProxyHeaderRead)
+			l.logger.Debug("Error reading PROXY protocol header", "client", client.RemoteAddr().String(), "conn_id", connID, "error", err)
+			entry.Reason = accesslog.ReasonSniffError
+			return
+		}
+		client = proxiedClient
+		entry.Client = client.RemoteAddr().String()
+	}
+	logger := l.logger.With("client", client.RemoteAddr().String(), "conn_id", connID)
+
+	var clientIP netip.Addr
+	if remoteAddr, ok := client.RemoteAddr().(*net.TCPAddr); ok {
+		clientIP = remoteAddr.AddrPort().Addr()
+	}
+	// Bans of the proxy itself have been checked on accept, but not those of the client behind it
+	if l.cfg.AcceptProxyProtocol && config.GetBans().Banned(clientIP) {
+		conn.BannedTotal.WithLabelValues(l.proto.String(), l.IPProto(), l.listener.Addr().String()).Inc()
+		// Like the ones dropped on accept, banned clients are not worth logging
+		accessLog = nil
+		return
+	}
+	release, err := config.GetClientLimiter().Acquire(clientIP)
+	if err != nil {
+		conn.RecordBanEvent(clientIP, ban.EventLimited)
+		conn.LimitedConnectionsTotal.WithLabelValues(l.proto.String(), l.IPProto(), l.listener.Addr().String(), "", limit.Reason(err)).Inc()
+		logger.Debug("Limited connection", "error", err)
+		entry.Reason = accesslog.ReasonLimited
+		return
+	}
+	defer release()
+
+	releaseListener, err := l.cfg.Slots.Acquire()
+	if err != nil {
+		conn.LimitedConnectionsTotal.WithLabelValues(l.proto.String(), l.IPProto(), l.listener.Addr().String(), "", limit.Reason(err)).Inc()
+		logger.Debug("Rejected connection", "error", err)
+		entry.Reason = accesslog.ReasonLimited
+		l.writeRejection(logger, client)
+		return
+	}
+	defer releaseListener()
+
+	// The deadline starts after waiting for a slot, as the client could not have been read from before
+	l.setSniffDeadline(client)
+	sniffClient := l.newSniffConn(client)
+	sniffStart := time.Now()
+
+	var clientConn vhost.Conn
 	switch l.proto {
 	case config.PROTO_HTTP:
-		clientConn, err = vhost.HTTP(client)
+		clientConn, err = vhost.HTTP(sniffClient)
 	case config.PROTO_HTTPS:
-		clientConn, err = vhost.TLS(client)
+		clientConn, err = vhost.TLS(sniffClient)
 	default:
-		log.Fatalf("Invalid TCP protocol %s", l.proto.String())
+		logging.Fatal(logger, "Invalid TCP protocol")
 		return
 	}
 	if err != nil {
-		if config.Verbose {
-			log.Printf("Error decoding protocol from %v: %v", client.RemoteAddr(), err)
+		l.countSniffError(err, sniffClient.readErr)
+		l.countFailure("", conn.FailureDecode)
+		if !sniffClient.closedEmpty() {
+			conn.RecordBanEvent(clientIP, ban.EventSniffFailure)
 		}
+		logger.Debug("Error decoding protocol", "error", err)
+		entry.Reason = accesslog.ReasonSniffError
 		return
 	}
+	conn.SniffDuration.WithLabelValues(l.proto.String(), l.IPProto(), l.listener.Addr().String()).Observe(time.Since(sniffStart).Seconds())
 
 	hostname := strings.ToLower(clientConn.Host())
+	logger = logger.With("host", hostname)
+	entry.Host = hostname
+	req := &config.Request{
+		Protocol: l.proto,
+		Hostname: hostname,
+		Source:   clientIP,
+	}
+	if localAddr, ok := client.LocalAddr().(*net.TCPAddr); ok && l.cfg.Intercept != config.INTERCEPT_NONE {
+		req.Destination = localAddr.AddrPort().Addr()
+	}
+	requestURI := ""
+	switch sniffedConn := clientConn.(type) {
+	case *vhost.HTTPConn:
+		req.Path = sniffedConn.Request.URL.Path
+		requestURI = sniffedConn.Request.URL.RequestURI()
+	case *vhost.TLSConn:
+		hello, err := parseClientHello(sniffedConn.ClientHelloMsg)
+		if err != nil {
+			l.countFailure("", conn.FailureClientHello)
+			logger.Debug("Error parsing ClientHello", "error", err)
+		} else {
+			req.ALPN = hello.ALPN
+			req.JA3 = fingerprint.JA3(hello)
+			req.JA4 = fingerprint.JA4(hello, false)
+			logger.Debug("Fingerprinted connection", "ja3", req.JA3, "ja4", req.JA4)
+		}
+	}
 	clientConn.Free()
-	backend, err := config.GetBackend(hostname, l.proto)
+	// Sniffing is done, from here on the connection is only limited by the client and backend
+	sniffClient.done = true
+	_ = client.SetReadDeadline(time.Time{})
+
+	backend, err := config.Route(req)
+	entry.JA3 = req.JA3
+	entry.JA4 = req.JA4
+	entry.Country = req.Country
+	entry.ASN = req.ASN
+	if errors.Is(err, config.ErrDenied) {
+		conn.DeniedConnectionsTotal.WithLabelValues(l.proto.String(), l.IPProto(), l.listener.Addr().String(), conn.HostLabel(backend, hostname)).Inc()
+		logger.Debug("Denied connection", "backend", backend.String())
+		entry.Match = backend.Match
+		entry.Reason = accesslog.ReasonDenied
+		return
+	}
+	if errors.Is(err, config.ErrDraining) {
+		l.countFailure(backend.String(), conn.FailureDraining)
+		logger.Debug("Rejected connection to draining backend", "backend", backend.String())
+		entry.Match = backend.Match
+		entry.Reason = accesslog.ReasonDraining
+		l.writeRejection(logger, clientConn)
+		return
+	}
 	if err != nil {
-		log.Printf("Couldn't get backend for %s: %v", hostname, err)
+		l.countFailure("", conn.FailureRoute)
+		logger.Error("Couldn't get backend", "error", err)
+		entry.Reason = accesslog.ReasonNoRoute
 		return
 	}
 
 	if backend == nil {
 		// This means we don't want to handle the connection
+		conn.RecordBanEvent(clientIP, ban.EventUnknownHost)
+		l.countFailure("", conn.FailureNoBackend)
+		entry.Reason = accesslog.ReasonNoRoute
 		return
 	}
+	logger = logger.With("backend", backend.String())
+	entry.Match = backend.Match
+	entry.Backend = backend.String()
+	hostLabel := conn.HostLabel(backend, hostname)
 
-	conn.OpenConnections.WithLabelValues(l.proto.String(), l.IPProto(), l.listener.Addr().String(), backend.Match, backend.String()).Inc()
-	conn.ConnectionsTotal.WithLabelValues(l.proto.String(), l.IPProto(), l.listener.Addr().String(), backend.Match, backend.String()).Inc()
-	defer conn.OpenConnections.WithLabelValues(l.proto.String(), l.IPProto(), l.listener.Addr().String(), backend.Match, backend.String()).Dec()
+	releaseBackend, err := backend.Limiter.Acquire(clientIP)
+	if err != nil {
+		conn.RecordBanEvent(clientIP, ban.EventLimited)
+		conn.LimitedConnectionsTotal.WithLabelValues(l.proto.String(), l.IPProto(), l.listener.Addr().String(), hostLabel, limit.Reason(err)).Inc()
+		logger.Debug("Limited connection", "error", err)
+		entry.Reason = accesslog.ReasonLimited
+		return
+	}
+	defer releaseBackend()
+
+	releaseSlot, err := backend.Slots.Acquire()
+	if err != nil {
+		conn.LimitedConnectionsTotal.WithLabelValues(l.proto.String(), l.IPProto(), l.listener.Addr().String(), hostLabel, limit.Reason(err)).Inc()
+		logger.Debug("Rejected connection", "error", err)
+		entry.Reason = accesslog.ReasonLimited
+		l.writeRejection(logger, clientConn)
+		return
+	}
+	defer releaseSlot()
+
+	// The gauge is looked up once, so it is decremented even if a reload changes the labels in the meantime
+	openConnections := conn.OpenConnections.WithLabelValues(l.proto.String(), l.IPProto(), l.listener.Addr().String(), hostLabel, backend.String())
+	openConnections.Inc()
+	conn.ConnectionsTotal.WithLabelValues(l.proto.String(), l.IPProto(), l.listener.Addr().String(), hostLabel, backend.String()).Inc()
+	conn.CountGeoConnection(l.proto.String(), l.IPProto(), l.listener.Addr().String(), hostLabel, req)
+	defer openConnections.Dec()
+
+	if backend.Tarpit {
+		// Tarpitted clients should not use up the backend slots of legitimate ones, the deferred releases do nothing afterwards.
+		// The client and listener slots are kept, so a single client cannot hold an unlimited number of tarpitted connections.
+		releaseSlot()
+		releaseBackend()
+		tarpit(clientConn)
+		entry.Reason = accesslog.ReasonTarpit
+		return
+	}
+
+	if backend.Redirect != "" {
+		err = writeRedirect(clientConn, hostname, requestURI, backend)
+		if err != nil {
+			logger.Debug("Could not write redirect", "error", err)
+		}
+		entry.Reason = accesslog.ReasonRedirect
+		return
+	}
 
 	useHost := backend.Host
 	if backend.HostPassthrough {
@@ -64,46 +253,121 @@ func (l *Listener) handleConnection(client net.Conn) {
 	}
 
 	ipport := fmt.Sprintf("[%s]:%d", useHost, backend.Port)
-	backendConn, err := net.DialTimeout("tcp", ipport, time.Duration(10000)*time.Millisecond)
+	dialStart := time.Now()
+	backendConn, err := conn.NewDialer(backend, client.RemoteAddr()).Dial("tcp", ipport)
 	if err != nil {
-		log.Printf("Couldn't dial backend connection for %s: %v", hostname, err)
+		l.countFailure(backend.String(), conn.FailureDial)
+		logger.Warn("Couldn't dial backend connection", "error", err)
+		entry.Reason = accesslog.ReasonDialError
 		return
 	}
+	conn.DialDuration.WithLabelValues(l.proto.String(), l.IPProto(), l.listener.Addr().String(), hostLabel, backend.String()).Observe(time.Since(dialStart).Seconds())
 	defer func() {
 		_ = backendConn.Close()
 	}()
 
-	if backend.ProxyProtocol {
-		err = proxy.WriteConn(clientConn, backendConn)
-		if err != nil {
-			log.Printf("Could not write PROXY protocol payload for %s: %v", hostname, err)
-			return
-		}
+	if backend.ProxyProtocolTLVs != nil && backend.ProxyProtocolTLVs.UniqueID {
+		logger.Info("Connection proxied")
+	}
+
+	switch backend.ProxyProtocol {
+	case config.PROXY_V1:
+		err = proxy.WriteConnV1(clientConn, backendConn)
+	case config.PROXY_V2:
+		err = proxy.WriteConn(clientConn, backendConn, conn.ProxyTLVs(backend, req, connID))
+	}
+	if err != nil {
+		l.countFailure(backend.String(), conn.FailureProxyHeaderWrite)
+		logger.Warn("Could not write PROXY protocol payload", "error", err)
+		entry.Reason = accesslog.ReasonError
+		return
 	}
 
-	joinConnections(clientConn, backendConn)
+	tracked := &conn.Tracked{
+		ID:       connID,
+		Proto:    l.proto.String(),
+		IPProto:  l.IPProto(),
+		Listener: l.listener.Addr().String(),
+		Client:   entry.Client,
+		Host:     hostname,
+		Match:    backend.Match,
+		Backend:  backend.String(),
+		Start:    entry.Time,
+		BytesIn:  &atomic.Int64{},
+		BytesOut: &atomic.Int64{},
+	}
+	untrack := conn.Track(tracked, func() {
+		_ = clientConn.Close()
+		_ = backendConn.Close()
+	})
+	defer untrack()
+
+	// The metrics are looked up once, so counting only costs atomic adds per write
+	bytesIn := conn.TrafficCounter{
+		Metric: conn.BytesTotal.WithLabelValues(l.proto.String(), l.IPProto(), l.listener.Addr().String(), hostLabel, backend.String(), "in"),
+		Total:  tracked.BytesIn,
+	}
+	bytesOut := conn.TrafficCounter{
+		Metric: conn.BytesTotal.WithLabelValues(l.proto.String(), l.IPProto(), l.listener.Addr().String(), hostLabel, backend.String(), "out"),
+		Total:  tracked.BytesOut,
+	}
+	entry.BytesIn, entry.BytesOut, entry.Reason = joinConnections(logger, clientConn, backendConn, bytesIn, bytesOut)
+	if tracked.Killed() {
+		entry.Reason = accesslog.ReasonKilled
+	}
+	conn.ConnectionDuration.WithLabelValues(l.proto.String(), l.IPProto(), l.listener.Addr().String(), hostLabel, backend.String()).Observe(time.Since(entry.Time).Seconds())
 }
 
-func halfJoin(wg *sync.WaitGroup, dst net.Conn, src net.Conn) {
+func halfJoin(logger *slog.Logger, dst net.Conn, src net.Conn, counter conn.TrafficCounter) int64 {
 	defer func() {
-		wg.Done()
 		_ = dst.Close()
 		_ = src.Close()
 	}()
 
-	_, err := io.Copy(dst, src)
-	if err == nil || errors.Is(err, net.ErrClosed) {
-		return
+	n, err := io.Copy(&conn.CountingWriter{Writer: dst, Counter: counter}, src)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		logger.Debug("Proxy copy failed", "from", src.RemoteAddr().String(), "to", dst.RemoteAddr().String(), "error", err)
+	}
+	return n
+}
+
+func (l *Listener) countFailure(backend string, reason string) {
+	conn.FailuresTotal.WithLabelValues(l.proto.String(), l.IPProto(), l.listener.Addr().String(), backend, reason).Inc()
+}
+
+// writeRejection tells the client that we are overloaded, in the protocol of the listener
+func (l *Listener) writeRejection(logger *slog.Logger, w io.Writer) {
+	var err error
+	switch l.proto {
+	case config.PROTO_HTTP:
+		err = writeUnavailable(w)
+	case config.PROTO_HTTPS:
+		err = writeAlert(w, tlsAlertDescriptionInternalError)
 	}
-	if config.Verbose {
-		log.Printf("Proxy copy from %v to %v failed with error %v", src.RemoteAddr(), dst.RemoteAddr(), err)
+	if err != nil {
+		logger.Debug("Could not write rejection", "error", err)
 	}
 }
 
-func joinConnections(c1 net.Conn, c2 net.Conn) {
+// joinConnections copies between client and backend until either closes,
+// counting and returning the bytes sent by the client and the backend and which of them closed first
+func joinConnections(logger *slog.Logger, client net.Conn, backend net.Conn, inCounter conn.TrafficCounter, outCounter conn.TrafficCounter) (int64, int64, accesslog.Reason) {
+	var bytesIn, bytesOut int64
+	closed := make(chan accesslog.Reason, 2)
+
 	var wg sync.WaitGroup
 	wg.Add(2)
-	go halfJoin(&wg, c1, c2)
-	go halfJoin(&wg, c2, c1)
+	go func() {
+		defer wg.Done()
+		bytesIn = halfJoin(logger, backend, client, inCounter)
+		closed <- accesslog.ReasonClientClose
+	}()
+	go func() {
+		defer wg.Done()
+		bytesOut = halfJoin(logger, client, backend, outCounter)
+		closed <- accesslog.ReasonBackendClose
+	}()
 	wg.Wait()
+
+	return bytesIn, bytesOut, <-closed
 }
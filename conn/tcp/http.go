@@ -0,0 +1,41 @@
+package tcp
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/Doridian/foxIngress/config"
+)
+
+func redirectLocation(hostname string, requestURI string, backend *config.BackendInfo) string {
+	host := backend.RedirectHost
+	if host == "" {
+		host = hostname
+		splitHost, _, err := net.SplitHostPort(hostname)
+		if err == nil {
+			host = splitHost
+			if strings.Contains(host, ":") {
+				host = "[" + host + "]"
+			}
+		}
+	}
+
+	if requestURI == "" || requestURI[0] != '/' {
+		requestURI = "/"
+	}
+
+	return fmt.Sprintf("%s://%s%s", backend.Redirect, host, requestURI)
+}
+
+func writeRedirect(w io.Writer, hostname string, requestURI string, backend *config.BackendInfo) error {
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nLocation: %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", backend.RedirectCode, http.StatusText(backend.RedirectCode), redirectLocation(hostname, requestURI, backend))
+	return err
+}
+
+func writeUnavailable(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
+	return err
+}
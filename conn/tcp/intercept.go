@@ -0,0 +1,39 @@
+package tcp
+
+import (
+	"net"
+
+	"github.com/Doridian/foxIngress/config"
+	"github.com/Doridian/foxIngress/util"
+)
+
+// interceptedConn is a connection redirected to us by netfilter, with the local address replaced by its original destination
+type interceptedConn struct {
+	net.Conn
+	localAddr net.Addr
+}
+
+func (c *interceptedConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+// interceptConn returns client with its original destination as the local address
+func (l *Listener) interceptConn(client net.Conn) (net.Conn, error) {
+	// With TPROXY, the socket is already bound to the original destination
+	if l.cfg.Intercept != config.INTERCEPT_REDIRECT {
+		return client, nil
+	}
+
+	tcpClient, ok := client.(*net.TCPConn)
+	if !ok {
+		return client, nil
+	}
+	dst, err := util.OriginalDestination(tcpClient)
+	if err != nil {
+		return nil, err
+	}
+	return &interceptedConn{
+		Conn:      client,
+		localAddr: net.TCPAddrFromAddrPort(dst),
+	}, nil
+}
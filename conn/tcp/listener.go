@@ -1,27 +1,40 @@
 package tcp
 
 import (
+	"context"
 	"errors"
-	"log"
+	"log/slog"
 	"net"
 
 	"github.com/Doridian/foxIngress/config"
 	"github.com/Doridian/foxIngress/conn"
+	"github.com/Doridian/foxIngress/util"
+	"github.com/Doridian/foxIngress/util/logging"
 )
 
+var logger = logging.New("tcp")
+
 type Listener struct {
 	listener net.Listener
 	proto    config.BackendProtocol
+	cfg      *config.ListenerConfig
+	logger   *slog.Logger
 }
 
 var _ conn.Listener = &Listener{}
 
-func NewListener(addr string, proto config.BackendProtocol) (*Listener, error) {
+func NewListener(cfg *config.ListenerConfig, proto config.BackendProtocol) (*Listener, error) {
 	if proto == config.PROTO_QUIC {
 		return nil, errors.New("TCP listener does not support QUIC")
 	}
 
-	listener, err := net.Listen("tcp", addr)
+	listenConfig := net.ListenConfig{}
+	if cfg.Intercept == config.INTERCEPT_TPROXY {
+		// TPROXY delivers connections for any address to us, which needs a transparent socket to accept them
+		listenConfig.Control = util.TransparentControl
+	}
+
+	listener, err := listenConfig.Listen(context.Background(), "tcp", cfg.Addr)
 	if err != nil {
 		return nil, err
 	}
@@ -29,6 +42,8 @@ func NewListener(addr string, proto config.BackendProtocol) (*Listener, error) {
 	return &Listener{
 		listener: listener,
 		proto:    proto,
+		cfg:      cfg,
+		logger:   logger.With("proto", proto.String(), "listener", listener.Addr().String()),
 	}, nil
 }
 
@@ -36,10 +51,16 @@ func (l *Listener) Start() {
 	for {
 		connection, err := l.listener.Accept()
 		if err != nil {
-			log.Printf("Accept error: %v", err)
+			l.logger.Error("Accept error", "error", err)
 			return
 		}
 
+		if remoteAddr, ok := connection.RemoteAddr().(*net.TCPAddr); ok && config.GetBans().Banned(remoteAddr.AddrPort().Addr()) {
+			conn.BannedTotal.WithLabelValues(l.proto.String(), l.IPProto(), l.listener.Addr().String()).Inc()
+			_ = connection.Close()
+			continue
+		}
+
 		go l.handleConnection(connection)
 	}
 }
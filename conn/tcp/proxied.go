@@ -0,0 +1,55 @@
+package tcp
+
+import (
+	"bufio"
+	"net"
+
+	"github.com/Doridian/foxIngress/util/proxy"
+)
+
+// proxiedConn is a connection from a trusted proxy, with the addresses taken from its PROXY protocol header
+type proxiedConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *proxiedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *proxiedConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (l *Listener) acceptProxyHeader(client net.Conn) (net.Conn, error) {
+	remoteAddr, ok := client.RemoteAddr().(*net.TCPAddr)
+	if !ok || !l.cfg.TrustsProxy(remoteAddr.AddrPort().Addr()) {
+		return client, nil
+	}
+
+	reader := bufio.NewReader(client)
+	hdr, err := proxy.Read(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	proxied := &proxiedConn{
+		Conn:       client,
+		reader:     reader,
+		remoteAddr: client.RemoteAddr(),
+		localAddr:  client.LocalAddr(),
+	}
+	// LOCAL headers (such as health checks of the proxy) and unknown address families keep the real addresses
+	if hdr.Command == proxy.CommandProxy && hdr.Source.IsValid() {
+		proxied.remoteAddr = net.TCPAddrFromAddrPort(hdr.Source)
+		proxied.localAddr = net.TCPAddrFromAddrPort(hdr.Destination)
+	}
+	return proxied, nil
+}
@@ -0,0 +1,75 @@
+package tcp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/Doridian/foxIngress/conn"
+)
+
+var errSniffTooLarge = errors.New("client sent too much data before it could be routed")
+
+// sniffConn limits how much can be read from a connection until it has been sniffed,
+// and remembers read errors, which the HTTP parser does not always pass on
+type sniffConn struct {
+	net.Conn
+	// remaining is the number of bytes that may still be read (if limited)
+	remaining int
+	// read is the number of bytes read while sniffing
+	read    int
+	limited bool
+	done    bool
+	readErr error
+}
+
+func (c *sniffConn) Read(b []byte) (int, error) {
+	if c.done {
+		return c.Conn.Read(b)
+	}
+	if c.limited {
+		if c.remaining <= 0 {
+			return 0, errSniffTooLarge
+		}
+		if len(b) > c.remaining {
+			b = b[:c.remaining]
+		}
+	}
+
+	n, err := c.Conn.Read(b)
+	c.remaining -= n
+	c.read += n
+	if err != nil {
+		c.readErr = err
+	}
+	return n, err
+}
+
+func (l *Listener) newSniffConn(client net.Conn) *sniffConn {
+	return &sniffConn{
+		Conn:      client,
+		remaining: l.cfg.MaxSniffSize,
+		limited:   l.cfg.MaxSniffSize > 0,
+	}
+}
+
+func (l *Listener) setSniffDeadline(client net.Conn) {
+	if l.cfg.SniffTimeout > 0 {
+		_ = client.SetReadDeadline(time.Now().Add(l.cfg.SniffTimeout))
+	}
+}
+
+// closedEmpty returns whether the client closed the connection without sending anything,
+// which is what TCP health checks of load balancers and orchestrators do
+func (c *sniffConn) closedEmpty() bool {
+	return c.read == 0 && errors.Is(c.readErr, io.EOF)
+}
+
+// countSniffError counts errs in the sniff timeout metric if any of them was caused by the sniff deadline
+func (l *Listener) countSniffError(errs ...error) {
+	if errors.Is(errors.Join(errs...), os.ErrDeadlineExceeded) {
+		conn.SniffTimeoutsTotal.WithLabelValues(l.proto.String(), l.IPProto(), l.listener.Addr().String()).Inc()
+	}
+}
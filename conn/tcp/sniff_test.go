@@ -0,0 +1,85 @@
+package tcp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Doridian/foxIngress/config"
+	"github.com/Doridian/foxIngress/conn"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSniffTimeoutSlowWriter(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yml")
+	err := os.WriteFile(configFile, []byte("hosts: {}\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", configFile)
+	config.Load()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const sniffTimeout = 300 * time.Millisecond
+	l := &Listener{
+		listener: ln,
+		proto:    config.PROTO_HTTPS,
+		cfg: &config.ListenerConfig{
+			Addr:         ln.Addr().String(),
+			SniffTimeout: sniffTimeout,
+		},
+		logger: logger,
+	}
+	go l.Start()
+	defer func() {
+		_ = ln.Close()
+	}()
+
+	timeouts := conn.SniffTimeoutsTotal.WithLabelValues(l.proto.String(), l.IPProto(), ln.Addr().String())
+	before := testutil.ToFloat64(timeouts)
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+
+	// Start of a TLS handshake record, sent one byte at a time so every read succeeds but the ClientHello never completes
+	start := time.Now()
+	go func() {
+		record := []byte{0x16, 0x03, 0x01, 0x02, 0x00, 0x01, 0x00, 0x01, 0xfc, 0x03, 0x03}
+		for {
+			for _, b := range record {
+				_, err := client.Write([]byte{b})
+				if err != nil {
+					return
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+			record = make([]byte, 16)
+		}
+	}()
+
+	_ = client.SetReadDeadline(time.Now().Add(5 * sniffTimeout))
+	_, err = io.ReadAll(client)
+	elapsed := time.Since(start)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("connection was still open after %v", elapsed)
+	}
+	if elapsed < sniffTimeout {
+		t.Errorf("connection was closed after %v, before the sniff timeout", elapsed)
+	}
+
+	if got := testutil.ToFloat64(timeouts) - before; got != 1 {
+		t.Errorf("sniff timeouts increased by %v, want 1", got)
+	}
+}
@@ -0,0 +1,16 @@
+package tcp
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// TarpitTimeout is how long connections of tarpitted clients are kept open
+var TarpitTimeout = 5 * time.Minute
+
+// tarpit keeps the connection open without ever answering, wasting the time of the client instead of ours
+func tarpit(client net.Conn) {
+	_ = client.SetReadDeadline(time.Now().Add(TarpitTimeout))
+	_, _ = io.Copy(io.Discard, client)
+}
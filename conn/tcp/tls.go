@@ -0,0 +1,51 @@
+package tcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/gaukas/clienthellod"
+	"github.com/inconshreveable/go-vhost"
+)
+
+const (
+	tlsRecordTypeAlert     = 0x15
+	tlsRecordTypeHandshake = 0x16
+
+	tlsAlertLevelFatal               = 2
+	tlsAlertDescriptionInternalError = 80
+)
+
+func parseClientHello(msg *vhost.ClientHelloMsg) (*clienthellod.ClientHello, error) {
+	if msg == nil {
+		return nil, errors.New("no ClientHello")
+	}
+	if len(msg.Raw) > 0xFFFF {
+		return nil, errors.New("ClientHello too large to fit into a single record")
+	}
+
+	// vhost reassembles the handshake message, so we wrap it back into a single record
+	record := make([]byte, 5, 5+len(msg.Raw))
+	record[0] = tlsRecordTypeHandshake
+	binary.BigEndian.PutUint16(record[1:3], msg.Vers)
+	binary.BigEndian.PutUint16(record[3:5], uint16(len(msg.Raw)))
+	record = append(record, msg.Raw...)
+
+	hello, err := clienthellod.ReadClientHello(bytes.NewReader(record))
+	if err != nil {
+		return nil, err
+	}
+	err = hello.ParseClientHello()
+	if err != nil {
+		return nil, err
+	}
+	return hello, nil
+}
+
+// writeAlert sends a fatal TLS alert, which clients show as an error instead of a broken connection
+func writeAlert(w io.Writer, description byte) error {
+	_, err := w.Write([]byte{tlsRecordTypeAlert, 0x03, 0x03, 0x00, 0x02, tlsAlertLevelFatal, description})
+	return err
+}
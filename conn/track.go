@@ -0,0 +1,138 @@
+package conn
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tracked is an open proxied connection, which can be listed and killed through the admin API
+type Tracked struct {
+	ID       string
+	Proto    string
+	IPProto  string
+	Listener string
+	Client   string
+	Host     string
+	Match    string
+	Backend  string
+	Start    time.Time
+
+	// BytesIn and BytesOut are updated while the connection is open
+	BytesIn  *atomic.Int64
+	BytesOut *atomic.Int64
+
+	close  func()
+	killed atomic.Bool
+}
+
+// TrackedInfo is a snapshot of a Tracked connection
+type TrackedInfo struct {
+	ID       string  `json:"id"`
+	Proto    string  `json:"proto"`
+	IPProto  string  `json:"ipproto"`
+	Listener string  `json:"listener"`
+	Client   string  `json:"client"`
+	Host     string  `json:"host"`
+	Match    string  `json:"match"`
+	Backend  string  `json:"backend"`
+	BytesIn  int64   `json:"bytes_in"`
+	BytesOut int64   `json:"bytes_out"`
+	Age      float64 `json:"age"`
+}
+
+var trackedLock sync.Mutex
+var tracked = make(map[string]*Tracked)
+
+// Track registers t as open until the returned function is called, close is called to kill it
+func Track(t *Tracked, close func()) func() {
+	t.close = close
+
+	trackedLock.Lock()
+	defer trackedLock.Unlock()
+	tracked[t.ID] = t
+
+	return func() {
+		trackedLock.Lock()
+		defer trackedLock.Unlock()
+		delete(tracked, t.ID)
+	}
+}
+
+// Killed returns whether the connection was closed by Kill
+func (t *Tracked) Killed() bool {
+	return t.killed.Load()
+}
+
+func (t *Tracked) kill() {
+	t.killed.Store(true)
+	t.close()
+}
+
+// TrackedConnections returns all open connections, oldest first
+func TrackedConnections() []TrackedInfo {
+	trackedLock.Lock()
+	all := make([]*Tracked, 0, len(tracked))
+	for _, t := range tracked {
+		all = append(all, t)
+	}
+	trackedLock.Unlock()
+
+	slices.SortFunc(all, func(a *Tracked, b *Tracked) int {
+		return a.Start.Compare(b.Start)
+	})
+
+	now := time.Now()
+	infos := make([]TrackedInfo, 0, len(all))
+	for _, t := range all {
+		infos = append(infos, TrackedInfo{
+			ID:       t.ID,
+			Proto:    t.Proto,
+			IPProto:  t.IPProto,
+			Listener: t.Listener,
+			Client:   t.Client,
+			Host:     t.Host,
+			Match:    t.Match,
+			Backend:  t.Backend,
+			BytesIn:  t.BytesIn.Load(),
+			BytesOut: t.BytesOut.Load(),
+			Age:      now.Sub(t.Start).Seconds(),
+		})
+	}
+	return infos
+}
+
+// Kill closes the connection with the given ID, returning whether it was open
+func Kill(id string) bool {
+	trackedLock.Lock()
+	t, ok := tracked[id]
+	trackedLock.Unlock()
+
+	if !ok {
+		return false
+	}
+	t.kill()
+	return true
+}
+
+// KillHost closes all connections for host (their hostname or the host entry they matched), returning how many
+func KillHost(host string) int {
+	host = strings.ToLower(host)
+
+	trackedLock.Lock()
+	var matches []*Tracked
+	for _, t := range tracked {
+		if t.Host == host || t.Match == host {
+			matches = append(matches, t)
+		}
+	}
+	trackedLock.Unlock()
+
+	// Closing can take locks of the connection, so it is done without holding ours
+	for _, t := range matches {
+		t.kill()
+	}
+	return len(matches)
+}
@@ -1,30 +1,68 @@
 package udp
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Doridian/foxIngress/config"
 	"github.com/Doridian/foxIngress/conn"
+	"github.com/Doridian/foxIngress/util/accesslog"
+	"github.com/Doridian/foxIngress/util/ban"
+	"github.com/Doridian/foxIngress/util/fingerprint"
+	"github.com/Doridian/foxIngress/util/limit"
+	"github.com/Doridian/foxIngress/util/logging"
 	"github.com/Doridian/foxIngress/util/proxy"
 	"github.com/gaukas/clienthellod"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type Conn struct {
+	id         string
 	remoteAddr *net.UDPAddr
+	// clientAddr and localAddr are the addresses of the client and listener,
+	// which are taken from PROXY protocol headers if a trusted proxy is in front of us
+	clientAddr *net.UDPAddr
+	localAddr  *net.UDPAddr
 
 	open     bool
 	openLock sync.Mutex
 
 	listener *Listener
+	logger   *slog.Logger
+	// releases are called on close to free the slots of the connection in the limiters
+	releases []func()
 
 	readerTimeout *time.Timer
 
 	backend *config.BackendInfo
-	beConn  *net.UDPConn
+	// hostLabel is the host label of the metrics of the connection
+	hostLabel string
+	beConn    *net.UDPConn
+	// tarpitted connections drop all packets until they time out
+	tarpitted bool
+
+	// req is what the connection was routed by
+	req *config.Request
+
+	// entry is written to the access log on close, it is protected by openLock as Close can run at any time
+	entry    accesslog.Entry
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+
+	// The traffic counters are looked up once the connection is routed, so counting is cheap
+	bytesInTotal    prometheus.Counter
+	bytesOutTotal   prometheus.Counter
+	packetsInTotal  prometheus.Counter
+	packetsOutTotal prometheus.Counter
+
+	// proxyHeader is prefixed to every datagram sent to the backend, if it wants that
+	proxyHeader []byte
+	sendBuf     []byte
 
 	inPackets chan []byte
 }
@@ -33,56 +71,177 @@ var IdleTimeout = 60 * time.Second
 
 const MaxPreBuff = 65536
 
+// packetQueueSize is how many datagrams from the client wait for a connection, more are dropped
+const packetQueueSize = 16
+
 func (c *Conn) handleQUICIP(pkt []byte) bool {
 	qHello, err := clienthellod.ParseQUICCIP(pkt)
 	if err != nil {
-		if config.Verbose {
-			log.Printf("Error parsing QUIC IP: %v", err)
-		}
+		c.listener.countFailure("", conn.FailureDecode)
+		c.logger.Debug("Error parsing QUIC IP", "error", err)
+		return false
+	}
+
+	release, err := c.listener.cfg.Slots.Acquire()
+	if err != nil {
+		conn.LimitedConnectionsTotal.WithLabelValues(c.listener.proto.String(), c.listener.IPProto(), c.listener.addr.String(), "", limit.Reason(err)).Inc()
+		c.logger.Debug("Rejected connection", "error", err)
+		c.closeWith(accesslog.ReasonLimited)
 		return false
 	}
+	c.addRelease(release)
 
 	serverName := qHello.QCH.ServerName
-	c.backend, err = config.GetBackend(serverName, config.PROTO_QUIC)
+	c.logger = c.logger.With("host", serverName)
+	req := &config.Request{
+		Protocol: config.PROTO_QUIC,
+		Hostname: serverName,
+		Source:   c.clientAddr.AddrPort().Addr(),
+		ALPN:     qHello.QCH.ALPN,
+
+		JA3:             fingerprint.JA3(&qHello.QCH.ClientHello),
+		JA4:             fingerprint.JA4(&qHello.QCH.ClientHello, true),
+		QUICFingerprint: qHello.QTP.HexID,
+	}
+	c.logger.Debug("Fingerprinted connection", "ja3", req.JA3, "ja4", req.JA4, "quic_fingerprint", req.QUICFingerprint)
+	c.req = req
+	c.backend, err = config.Route(req)
+	c.openLock.Lock()
+	c.entry.Host = serverName
+	c.entry.JA3 = req.JA3
+	c.entry.JA4 = req.JA4
+	c.entry.QUICFingerprint = req.QUICFingerprint
+	c.entry.Country = req.Country
+	c.entry.ASN = req.ASN
+	if c.backend != nil {
+		c.entry.Match = c.backend.Match
+	}
+	c.openLock.Unlock()
+	if errors.Is(err, config.ErrDraining) {
+		c.listener.countFailure(c.backend.String(), conn.FailureDraining)
+		c.logger.Debug("Rejected connection to draining backend", "backend", c.backend.String())
+		c.closeWith(accesslog.ReasonDraining)
+		return false
+	}
+	if errors.Is(err, config.ErrDenied) {
+		conn.DeniedConnectionsTotal.WithLabelValues(c.listener.proto.String(), c.listener.IPProto(), c.listener.addr.String(), conn.HostLabel(c.backend, serverName)).Inc()
+		c.logger.Debug("Denied connection", "backend", c.backend.String())
+		c.closeWith(accesslog.ReasonDenied)
+		return false
+	}
 	if err != nil {
-		log.Printf("Error finding backend for %s: %v", serverName, err)
-		_ = c.Close()
+		c.listener.countFailure("", conn.FailureRoute)
+		c.logger.Error("Error finding backend", "error", err)
+		c.closeWith(accesslog.ReasonNoRoute)
 		return false
 	}
 
 	if c.backend == nil {
 		// This means we don't want to handle the connection
-		_ = c.Close()
+		conn.RecordBanEvent(req.Source, ban.EventUnknownHost)
+		c.listener.countFailure("", conn.FailureNoBackend)
+		c.closeWith(accesslog.ReasonNoRoute)
+		return false
+	}
+	c.logger = c.logger.With("backend", c.backend.String())
+	c.hostLabel = conn.HostLabel(c.backend, serverName)
+	c.openLock.Lock()
+	c.entry.Backend = c.backend.String()
+	c.openLock.Unlock()
+
+	if c.backend.Tarpit {
+		// Keep the flow, so all further packets of the client are dropped until it times out
+		conn.ConnectionsTotal.WithLabelValues(c.listener.proto.String(), c.listener.IPProto(), c.listener.addr.String(), c.hostLabel, c.backend.String()).Inc()
+		conn.CountGeoConnection(c.listener.proto.String(), c.listener.IPProto(), c.listener.addr.String(), c.hostLabel, req)
+		c.tarpitted = true
+		c.setReason(accesslog.ReasonTarpit)
 		return false
 	}
 
+	release, err = c.backend.Limiter.Acquire(req.Source)
+	if err != nil {
+		conn.RecordBanEvent(req.Source, ban.EventLimited)
+		conn.LimitedConnectionsTotal.WithLabelValues(c.listener.proto.String(), c.listener.IPProto(), c.listener.addr.String(), c.hostLabel, limit.Reason(err)).Inc()
+		c.logger.Debug("Limited connection", "error", err)
+		c.closeWith(accesslog.ReasonLimited)
+		return false
+	}
+	c.addRelease(release)
+
+	release, err = c.backend.Slots.Acquire()
+	if err != nil {
+		conn.LimitedConnectionsTotal.WithLabelValues(c.listener.proto.String(), c.listener.IPProto(), c.listener.addr.String(), c.hostLabel, limit.Reason(err)).Inc()
+		c.logger.Debug("Rejected connection", "error", err)
+		c.closeWith(accesslog.ReasonLimited)
+		return false
+	}
+	c.addRelease(release)
+
 	useHost := c.backend.Host
 	if c.backend.HostPassthrough {
 		useHost = serverName
 	}
 
-	udpAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("[%s]:%d", useHost, c.backend.Port))
+	dialStart := time.Now()
+	beConn, err := conn.NewDialer(c.backend, c.clientAddr).Dial("udp", fmt.Sprintf("[%s]:%d", useHost, c.backend.Port))
 	if err != nil {
-		log.Printf("Error resolving UDP address for %s: %v", serverName, err)
-		_ = c.Close()
+		c.listener.countFailure(c.backend.String(), conn.FailureDial)
+		c.logger.Warn("Error dialing backend", "error", err)
+		c.closeWith(accesslog.ReasonDialError)
 		return false
 	}
-	c.beConn, err = net.DialUDP("udp", nil, udpAddr)
-	if err != nil {
-		log.Printf("Error dialing UDP for %s: %v", serverName, err)
-		_ = c.Close()
-		return false
+	c.beConn = beConn.(*net.UDPConn)
+	conn.DialDuration.WithLabelValues(c.listener.proto.String(), c.listener.IPProto(), c.listener.addr.String(), c.hostLabel, c.backend.String()).Observe(time.Since(dialStart).Seconds())
+
+	c.bytesInTotal = conn.BytesTotal.WithLabelValues(c.listener.proto.String(), c.listener.IPProto(), c.listener.addr.String(), c.hostLabel, c.backend.String(), "in")
+	c.bytesOutTotal = conn.BytesTotal.WithLabelValues(c.listener.proto.String(), c.listener.IPProto(), c.listener.addr.String(), c.hostLabel, c.backend.String(), "out")
+	c.packetsInTotal = conn.PacketsTotal.WithLabelValues(c.listener.proto.String(), c.listener.IPProto(), c.listener.addr.String(), c.hostLabel, c.backend.String(), "in")
+	c.packetsOutTotal = conn.PacketsTotal.WithLabelValues(c.listener.proto.String(), c.listener.IPProto(), c.listener.addr.String(), c.hostLabel, c.backend.String(), "out")
+
+	if c.backend.ProxyProtocolTLVs != nil && c.backend.ProxyProtocolTLVs.UniqueID {
+		c.logger.Info("Connection proxied")
 	}
 
-	if c.backend.ProxyProtocol {
-		err = proxy.WriteConn(c, c.beConn)
+	if c.backend.ProxyProtocol == config.PROXY_V2 {
+		header, err := proxy.MakeConnPayload(c, conn.ProxyTLVs(c.backend, req, c.id))
 		if err != nil {
-			log.Printf("Could not write PROXY protocol payload for %s: %v", serverName, err)
-			_ = c.Close()
+			c.listener.countFailure(c.backend.String(), conn.FailureProxyHeaderWrite)
+			c.logger.Warn("Could not build PROXY protocol payload", "error", err)
+			c.closeWith(accesslog.ReasonError)
 			return false
 		}
+
+		if c.backend.ProxyProtocolPerDatagram {
+			c.proxyHeader = header
+			c.sendBuf = make([]byte, 0, len(header)+MaxPreBuff)
+		} else {
+			_, err = c.beConn.Write(header)
+			if err != nil {
+				c.listener.countFailure(c.backend.String(), conn.FailureProxyHeaderWrite)
+				c.logger.Warn("Could not write PROXY protocol payload", "error", err)
+				c.closeWith(accesslog.ReasonError)
+				return false
+			}
+		}
 	}
 
+	untrack := conn.Track(&conn.Tracked{
+		ID:       c.id,
+		Proto:    c.listener.proto.String(),
+		IPProto:  c.listener.IPProto(),
+		Listener: c.listener.addr.String(),
+		Client:   c.clientAddr.String(),
+		Host:     serverName,
+		Match:    c.backend.Match,
+		Backend:  c.backend.String(),
+		Start:    c.entry.Time,
+		BytesIn:  &c.bytesIn,
+		BytesOut: &c.bytesOut,
+	}, func() {
+		c.closeWith(accesslog.ReasonKilled)
+	})
+	c.addRelease(untrack)
+
 	return true
 }
 
@@ -91,10 +250,8 @@ func (c *Conn) beReader() {
 	for c.open {
 		n, _, err := c.beConn.ReadFromUDP(buf)
 		if err != nil {
-			if config.Verbose {
-				log.Printf("Error reading from backend: %v", err)
-			}
-			_ = c.Close()
+			c.logger.Debug("Error reading from backend", "error", err)
+			c.closeWith(accesslog.ReasonBackendClose)
 			return
 		}
 
@@ -102,12 +259,13 @@ func (c *Conn) beReader() {
 
 		_, err = c.Write(buf[:n])
 		if err != nil {
-			if config.Verbose {
-				log.Printf("Error writing to client: %v", err)
-			}
-			_ = c.Close()
+			c.logger.Debug("Error writing to client", "error", err)
+			c.closeWith(accesslog.ReasonClientClose)
 			return
 		}
+		c.bytesOut.Add(int64(n))
+		c.bytesOutTotal.Add(float64(n))
+		c.packetsOutTotal.Inc()
 	}
 }
 
@@ -118,7 +276,7 @@ func (c *Conn) initHandler(pkt []byte) bool {
 		initOK = c.handleQUICIP(pkt)
 	default:
 		_ = c.Close()
-		log.Fatalf("Invalid UDP protocol %s", c.listener.proto.String())
+		logging.Fatal(c.logger, "Invalid UDP protocol")
 		return false
 	}
 
@@ -132,25 +290,43 @@ func (c *Conn) initHandler(pkt []byte) bool {
 
 func (c *Conn) chReader() {
 	for c.open {
-		pkt := <-c.inPackets
+		pkt, ok := <-c.inPackets
+		if !ok {
+			return
+		}
+
+		if c.tarpitted {
+			continue
+		}
 
 		if c.beConn == nil {
 			if !c.initHandler(pkt) {
 				continue
 			}
 
-			conn.ConnectionsTotal.WithLabelValues(c.listener.proto.String(), c.listener.IPProto(), c.listener.addr.String(), c.backend.Match, c.backend.String()).Inc()
-			conn.OpenConnections.WithLabelValues(c.listener.proto.String(), c.listener.IPProto(), c.listener.addr.String(), c.backend.Match, c.backend.String()).Inc()
-			defer conn.OpenConnections.WithLabelValues(c.listener.proto.String(), c.listener.IPProto(), c.listener.addr.String(), c.backend.Match, c.backend.String()).Dec()
+			conn.ConnectionsTotal.WithLabelValues(c.listener.proto.String(), c.listener.IPProto(), c.listener.addr.String(), c.hostLabel, c.backend.String()).Inc()
+			conn.CountGeoConnection(c.listener.proto.String(), c.listener.IPProto(), c.listener.addr.String(), c.hostLabel, c.req)
+			// Resolved once, as a reload can change the labels before the flow ends
+			openConnections := conn.OpenConnections.WithLabelValues(c.listener.proto.String(), c.listener.IPProto(), c.listener.addr.String(), c.hostLabel, c.backend.String())
+			openConnections.Inc()
+			defer openConnections.Dec()
+		}
+
+		n := len(pkt)
+		if c.proxyHeader != nil {
+			c.sendBuf = append(append(c.sendBuf[:0], c.proxyHeader...), pkt...)
+			pkt = c.sendBuf
 		}
 
 		_, err := c.beConn.Write(pkt)
 		if err != nil {
-			if config.Verbose {
-				log.Printf("Error writing to backend: %v", err)
-			}
+			c.logger.Debug("Error writing to backend", "error", err)
+			c.setReason(accesslog.ReasonBackendClose)
 			return
 		}
+		c.bytesIn.Add(int64(n))
+		c.bytesInTotal.Add(float64(n))
+		c.packetsInTotal.Inc()
 	}
 }
 
@@ -158,10 +334,19 @@ func (c *Conn) init() {
 	c.openLock.Lock()
 	defer c.openLock.Unlock()
 
-	c.inPackets = make(chan []byte, 16)
+	c.id = conn.NewID()
+	c.logger = c.listener.logger.With("client", c.clientAddr.String(), "conn_id", c.id)
+	c.entry = accesslog.Entry{
+		Time:     time.Now(),
+		ConnID:   c.id,
+		Client:   c.clientAddr.String(),
+		Listener: c.listener.addr.String(),
+		Proto:    c.listener.proto.String(),
+	}
+	c.inPackets = make(chan []byte, packetQueueSize)
 
 	c.readerTimeout = time.AfterFunc(IdleTimeout, func() {
-		_ = c.Close()
+		c.closeWith(accesslog.ReasonIdleTimeout)
 	})
 
 	c.open = true
@@ -170,10 +355,20 @@ func (c *Conn) init() {
 }
 
 func (c *Conn) handlePacket(buf []byte) {
+	// Close closes inPackets while holding openLock, so it has to be held until the packet is queued
+	c.openLock.Lock()
+	defer c.openLock.Unlock()
+
 	if !c.open {
 		return
 	}
-	c.inPackets <- buf
+
+	select {
+	case c.inPackets <- buf:
+	default:
+		// All flows share the reader of the listener, which must not wait for this one (such as while it waits for a slot or dials)
+		conn.DroppedPacketsTotal.WithLabelValues(c.listener.proto.String(), c.listener.IPProto(), c.listener.addr.String()).Inc()
+	}
 }
 
 func (c *Conn) Close() error {
@@ -191,10 +386,52 @@ func (c *Conn) Close() error {
 
 	if wasOpen {
 		close(c.inPackets)
+		for _, release := range c.releases {
+			release()
+		}
+
+		if c.entry.Reason == "" {
+			// Only the listener closes connections without a reason
+			c.entry.Reason = accesslog.ReasonShutdown
+		}
+		c.entry.BytesIn = c.bytesIn.Load()
+		c.entry.BytesOut = c.bytesOut.Load()
+		c.entry.Duration = time.Since(c.entry.Time)
+		config.GetAccessLog().Log(&c.entry)
+		if c.beConn != nil {
+			conn.ConnectionDuration.WithLabelValues(c.listener.proto.String(), c.listener.IPProto(), c.listener.addr.String(), c.hostLabel, c.backend.String()).Observe(c.entry.Duration.Seconds())
+		}
 	}
 	return nil
 }
 
+// setReason records why the connection ends, the first reason set wins
+func (c *Conn) setReason(reason accesslog.Reason) {
+	c.openLock.Lock()
+	defer c.openLock.Unlock()
+
+	if c.entry.Reason == "" {
+		c.entry.Reason = reason
+	}
+}
+
+func (c *Conn) closeWith(reason accesslog.Reason) {
+	c.setReason(reason)
+	_ = c.Close()
+}
+
+func (c *Conn) addRelease(release func()) {
+	c.openLock.Lock()
+	defer c.openLock.Unlock()
+
+	if !c.open {
+		// Close already ran, so nobody else will release this
+		release()
+		return
+	}
+	c.releases = append(c.releases, release)
+}
+
 func (c *Conn) Write(b []byte) (n int, err error) {
 	if !c.open {
 		return 0, net.ErrClosed
@@ -204,9 +441,9 @@ func (c *Conn) Write(b []byte) (n int, err error) {
 }
 
 func (c *Conn) LocalAddr() net.Addr {
-	return c.listener.addr
+	return c.localAddr
 }
 
 func (c *Conn) RemoteAddr() net.Addr {
-	return c.remoteAddr
+	return c.clientAddr
 }
@@ -4,6 +4,7 @@ import "net"
 
 type connectionKey string
 
-func makeConnKey(addr *net.UDPAddr) connectionKey {
-	return connectionKey(addr.String())
+// makeConnKey identifies a flow by the address packets come from and the client behind it (which differ if a proxy is in front of us)
+func makeConnKey(addr *net.UDPAddr, clientAddr *net.UDPAddr) connectionKey {
+	return connectionKey(addr.String() + "|" + clientAddr.String())
 }
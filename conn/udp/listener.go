@@ -1,20 +1,29 @@
 package udp
 
 import (
+	"bytes"
 	"context"
 	"errors"
-	"log"
+	"log/slog"
 	"net"
 	"sync"
 
 	"github.com/Doridian/foxIngress/config"
 	"github.com/Doridian/foxIngress/conn"
+	"github.com/Doridian/foxIngress/util/ban"
+	"github.com/Doridian/foxIngress/util/limit"
+	"github.com/Doridian/foxIngress/util/logging"
+	"github.com/Doridian/foxIngress/util/proxy"
 )
 
+var logger = logging.New("udp")
+
 type Listener struct {
 	addr    *net.UDPAddr
 	udpConn *net.UDPConn
 	proto   config.BackendProtocol
+	cfg     *config.ListenerConfig
+	logger  *slog.Logger
 
 	listenCtx    context.Context
 	listenCancel context.CancelFunc
@@ -37,12 +46,12 @@ func (l *Listener) Start() {
 	<-l.listenCtx.Done()
 }
 
-func NewListener(addr string, proto config.BackendProtocol) (*Listener, error) {
+func NewListener(cfg *config.ListenerConfig, proto config.BackendProtocol) (*Listener, error) {
 	if proto != config.PROTO_QUIC {
 		return nil, errors.New("UDP listener only supports QUIC")
 	}
 
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	udpAddr, err := net.ResolveUDPAddr("udp", cfg.Addr)
 	if err != nil {
 		return nil, err
 	}
@@ -55,6 +64,8 @@ func NewListener(addr string, proto config.BackendProtocol) (*Listener, error) {
 	l := &Listener{
 		addr:    udpAddr,
 		proto:   proto,
+		cfg:     cfg,
+		logger:  logger.With("proto", proto.String(), "listener", udpAddr.String()),
 		udpConn: conn,
 		conns:   make(map[connectionKey]*Conn),
 	}
@@ -62,7 +73,7 @@ func NewListener(addr string, proto config.BackendProtocol) (*Listener, error) {
 }
 
 func (l *Listener) removeConn(connObj *Conn) {
-	connKey := makeConnKey(connObj.remoteAddr)
+	connKey := makeConnKey(connObj.remoteAddr, connObj.clientAddr)
 
 	l.connLock.Lock()
 	defer l.connLock.Unlock()
@@ -70,14 +81,51 @@ func (l *Listener) removeConn(connObj *Conn) {
 }
 
 func (l *Listener) handlePacket(buf []byte, addr *net.UDPAddr) {
-	connKey := makeConnKey(addr)
+	clientAddr := addr
+	localAddr := l.addr
+	if l.cfg.AcceptProxyProtocol && l.cfg.TrustsProxy(addr.AddrPort().Addr()) {
+		// Proxies prefix every datagram with a header
+		hdr, n, err := proxy.Parse(buf)
+		if err != nil {
+			l.countFailure("", conn.FailureProxyHeaderRead)
+			l.logger.Debug("Error reading PROXY protocol header", "client", addr.String(), "error", err)
+			return
+		}
+		buf = buf[n:]
+		if hdr.Command == proxy.CommandProxy && hdr.Source.IsValid() {
+			clientAddr = net.UDPAddrFromAddrPort(hdr.Source)
+			localAddr = net.UDPAddrFromAddrPort(hdr.Destination)
+		}
+		if len(buf) == 0 {
+			return
+		}
+	}
+
+	if config.GetBans().Banned(clientAddr.AddrPort().Addr()) {
+		conn.BannedTotal.WithLabelValues(l.proto.String(), l.IPProto(), l.addr.String()).Inc()
+		return
+	}
+
+	connKey := makeConnKey(addr, clientAddr)
 
 	l.connLock.Lock()
 	connObj, ok := l.conns[connKey]
 	if !ok || !connObj.open {
+		release, err := config.GetClientLimiter().Acquire(clientAddr.AddrPort().Addr())
+		if err != nil {
+			l.connLock.Unlock()
+			conn.RecordBanEvent(clientAddr.AddrPort().Addr(), ban.EventLimited)
+			conn.LimitedConnectionsTotal.WithLabelValues(l.proto.String(), l.IPProto(), l.addr.String(), "", limit.Reason(err)).Inc()
+			l.logger.Debug("Limited connection", "client", clientAddr.String(), "error", err)
+			return
+		}
+
 		connObj = &Conn{
 			remoteAddr: addr,
+			clientAddr: clientAddr,
+			localAddr:  localAddr,
 			listener:   l,
+			releases:   []func(){release},
 		}
 		connObj.init()
 		l.conns[connKey] = connObj
@@ -88,17 +136,22 @@ func (l *Listener) handlePacket(buf []byte, addr *net.UDPAddr) {
 	connObj.handlePacket(buf)
 }
 
+func (l *Listener) countFailure(backend string, reason string) {
+	conn.FailuresTotal.WithLabelValues(l.proto.String(), l.IPProto(), l.addr.String(), backend, reason).Inc()
+}
+
 func (l *Listener) reader() {
 	buf := make([]byte, 65535)
 	for l.running {
 		n, addr, err := l.udpConn.ReadFromUDP(buf)
 		if err != nil {
-			log.Printf("Error reading from UDP: %v", err)
+			l.logger.Error("Error reading from UDP", "error", err)
 			_ = l.Close()
 			return
 		}
 
-		l.handlePacket(buf[:n], addr)
+		// The packet is queued for the connection, so it can not share our read buffer
+		l.handlePacket(bytes.Clone(buf[:n]), addr)
 	}
 }
 
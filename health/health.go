@@ -0,0 +1,178 @@
+package health
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Doridian/foxIngress/config"
+)
+
+// ListenerState is the lifecycle state of a proxy listener
+type ListenerState int
+
+const (
+	ListenerStarting ListenerState = iota
+	ListenerBound
+	ListenerAccepting
+)
+
+func (s ListenerState) String() string {
+	switch s {
+	case ListenerStarting:
+		return "starting"
+	case ListenerBound:
+		return "bound"
+	case ListenerAccepting:
+		return "accepting"
+	default:
+		return "unknown"
+	}
+}
+
+var privilegesDropped atomic.Bool
+
+var listenersLock sync.Mutex
+var listeners = make(map[string]ListenerState)
+
+// SetPrivilegesDropped marks the privileges as dropped, after which listeners start accepting
+func SetPrivilegesDropped() {
+	privilegesDropped.Store(true)
+}
+
+// SetListenerState records the state of the listener called name, listeners should be set to ListenerStarting
+// before the health endpoints are served, so they are known to be missing until they are bound
+func SetListenerState(name string, state ListenerState) {
+	listenersLock.Lock()
+	defer listenersLock.Unlock()
+	listeners[name] = state
+}
+
+type check struct {
+	name string
+	err  error
+}
+
+func listenerChecks(ok func(state ListenerState) bool) []check {
+	listenersLock.Lock()
+	names := make([]string, 0, len(listeners))
+	for name := range listeners {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	checks := make([]check, 0, len(names))
+	for _, name := range names {
+		var err error
+		state := listeners[name]
+		if !ok(state) {
+			err = fmt.Errorf("state is %s", state)
+		}
+		checks = append(checks, check{name: "listener " + name, err: err})
+	}
+	listenersLock.Unlock()
+
+	return checks
+}
+
+// BackendCheckInterval is how long the result of checking the backends is reused for
+const BackendCheckInterval = 10 * time.Second
+
+var backendCheckLock sync.Mutex
+var backendCheckTime time.Time
+var backendCheckErr error
+
+// cachedCheckBackends returns the result of the last backend check if it is recent enough, so frequent probes do not
+// dial every backend each time. Concurrent probes wait for a single check in progress.
+func cachedCheckBackends() error {
+	backendCheckLock.Lock()
+	defer backendCheckLock.Unlock()
+
+	if !backendCheckTime.IsZero() && time.Since(backendCheckTime) < BackendCheckInterval {
+		return backendCheckErr
+	}
+	backendCheckErr = checkBackends()
+	backendCheckTime = time.Now()
+	return backendCheckErr
+}
+
+// checkBackends succeeds if any TCP backend accepts a connection
+func checkBackends() error {
+	addrs := config.GetTCPBackendAddrs()
+	if len(addrs) == 0 {
+		return errors.New("no TCP backends configured")
+	}
+
+	timeout := config.GetHealthConfig().BackendTimeout
+	results := make(chan error, len(addrs))
+	for _, addr := range addrs {
+		go func() {
+			backendConn, err := net.DialTimeout("tcp", addr, timeout)
+			if err == nil {
+				_ = backendConn.Close()
+			}
+			results <- err
+		}()
+	}
+
+	for range addrs {
+		if <-results == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("none of %d backends is reachable", len(addrs))
+}
+
+func writeChecks(w http.ResponseWriter, checks []check) {
+	status := http.StatusOK
+	var body strings.Builder
+	for _, c := range checks {
+		if c.err != nil {
+			status = http.StatusServiceUnavailable
+			fmt.Fprintf(&body, "[-]%s failed: %v\n", c.name, c.err)
+		} else {
+			fmt.Fprintf(&body, "[+]%s ok\n", c.name)
+		}
+	}
+	if status == http.StatusOK {
+		body.WriteString("ok\n")
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(body.String()))
+}
+
+// Healthz reports whether the process is alive, which it is whenever it answers (it exits if a listener stops)
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	writeChecks(w, nil)
+}
+
+// Readyz reports whether connections are proxied: privileges are dropped and all listeners are accepting.
+// If configured, at least one backend also has to be reachable. It is served as soon as the config is loaded.
+func Readyz(w http.ResponseWriter, r *http.Request) {
+	checks := []check{
+		{name: "privileges"},
+	}
+	if !privilegesDropped.Load() {
+		checks[0].err = errors.New("privileges are not dropped")
+	}
+
+	checks = append(checks, listenerChecks(func(state ListenerState) bool {
+		return state == ListenerAccepting
+	})...)
+
+	healthCfg := config.GetHealthConfig()
+	if healthCfg != nil && healthCfg.RequireBackend {
+		checks = append(checks, check{name: "backends", err: cachedCheckBackends()})
+	}
+
+	writeChecks(w, checks)
+}
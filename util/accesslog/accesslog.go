@@ -0,0 +1,209 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	FORMAT_JSON     = "json"
+	FORMAT_LOGFMT   = "logfmt"
+	FORMAT_TEMPLATE = "template"
+)
+
+// Reason is why a connection ended
+type Reason string
+
+const (
+	ReasonClientClose  Reason = "client_close"
+	ReasonBackendClose Reason = "backend_close"
+	ReasonIdleTimeout  Reason = "idle_timeout"
+	ReasonDialError    Reason = "dial_error"
+	ReasonNoRoute      Reason = "no_route"
+	ReasonSniffError   Reason = "sniff_error"
+	ReasonDenied       Reason = "denied"
+	ReasonLimited      Reason = "limited"
+	ReasonDraining     Reason = "draining"
+	ReasonKilled       Reason = "killed"
+	ReasonTarpit       Reason = "tarpit"
+	ReasonRedirect     Reason = "redirect"
+	ReasonShutdown     Reason = "shutdown"
+	ReasonError        Reason = "error"
+)
+
+// Entry describes a single TCP connection or UDP flow
+type Entry struct {
+	Time     time.Time
+	ConnID   string
+	Client   string
+	Listener string
+	Proto    string
+	Host     string
+	// Match is the host entry (or rule) of the config the connection was routed by
+	Match   string
+	Backend string
+
+	JA3 string
+	JA4 string
+	// QUICFingerprint is the fingerprint of the QUIC transport parameters (QUIC only)
+	QUICFingerprint string
+	Country         string
+	ASN             uint
+
+	// BytesIn were sent by the client, BytesOut by the backend
+	BytesIn  int64
+	BytesOut int64
+	Duration time.Duration
+	Reason   Reason
+}
+
+type field struct {
+	key   string
+	value any
+}
+
+func (e *Entry) fields() []field {
+	return []field{
+		{"time", e.Time.Format(time.RFC3339Nano)},
+		{"conn_id", e.ConnID},
+		{"client", e.Client},
+		{"listener", e.Listener},
+		{"proto", e.Proto},
+		{"host", e.Host},
+		{"match", e.Match},
+		{"backend", e.Backend},
+		{"ja3", e.JA3},
+		{"ja4", e.JA4},
+		{"quic_fingerprint", e.QUICFingerprint},
+		{"country", e.Country},
+		{"asn", e.ASN},
+		{"bytes_in", e.BytesIn},
+		{"bytes_out", e.BytesOut},
+		{"duration", e.Duration.Seconds()},
+		{"reason", string(e.Reason)},
+	}
+}
+
+// Logger writes access log entries in the configured format.
+// A nil Logger discards everything.
+type Logger struct {
+	lock     sync.Mutex
+	writer   io.Writer
+	format   string
+	template *template.Template
+}
+
+// New creates a Logger writing to output, which is stdout, stderr, syslog (local, or syslog://host:port over UDP
+// and syslog+tcp://host:port) or a file path.
+// The template is only used by FORMAT_TEMPLATE and executed with an Entry.
+func New(output string, format string, tmpl string) (*Logger, error) {
+	l := &Logger{
+		format: format,
+	}
+
+	switch format {
+	case FORMAT_JSON, FORMAT_LOGFMT:
+	case FORMAT_TEMPLATE:
+		var err error
+		l.template, err = template.New("access_log").Parse(tmpl)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid access log format %q", format)
+	}
+
+	writer, err := openOutput(output)
+	if err != nil {
+		return nil, err
+	}
+	l.writer = writer
+
+	return l, nil
+}
+
+func openOutput(output string) (io.Writer, error) {
+	switch {
+	case output == "stdout":
+		return os.Stdout, nil
+	case output == "stderr":
+		return os.Stderr, nil
+	case output == "syslog":
+		return openSyslog("", "")
+	case strings.HasPrefix(output, "syslog://"):
+		return openSyslog("udp", strings.TrimPrefix(output, "syslog://"))
+	case strings.HasPrefix(output, "syslog+tcp://"):
+		return openSyslog("tcp", strings.TrimPrefix(output, "syslog+tcp://"))
+	}
+	return os.OpenFile(output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
+
+// Log writes an entry
+func (l *Logger) Log(e *Entry) {
+	if l == nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	switch l.format {
+	case FORMAT_JSON:
+		writeJSON(&buf, e)
+	case FORMAT_LOGFMT:
+		writeLogfmt(&buf, e)
+	case FORMAT_TEMPLATE:
+		err := l.template.Execute(&buf, e)
+		if err != nil {
+			buf.Reset()
+			fmt.Fprintf(&buf, "access log template error: %v", err)
+		}
+	}
+	buf.WriteByte('\n')
+
+	// Every entry is one write, so syslog gets one message per entry
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	_, _ = l.writer.Write(buf.Bytes())
+}
+
+func writeJSON(buf *bytes.Buffer, e *Entry) {
+	buf.WriteByte('{')
+	for i, f := range e.fields() {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(f.key)
+		value, _ := json.Marshal(f.value)
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+}
+
+func writeLogfmt(buf *bytes.Buffer, e *Entry) {
+	for i, f := range e.fields() {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(f.key)
+		buf.WriteByte('=')
+
+		value := fmt.Sprint(f.value)
+		if value == "" || strings.ContainsAny(value, " =\"\\") || strings.ContainsFunc(value, isControl) {
+			value = strconv.Quote(value)
+		}
+		buf.WriteString(value)
+	}
+}
+
+func isControl(r rune) bool {
+	return r < ' ' || r == 0x7f
+}
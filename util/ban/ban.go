@@ -0,0 +1,283 @@
+package ban
+
+import (
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Doridian/foxIngress/util/logging"
+)
+
+var logger = logging.New("ban")
+
+// Event is something a client did which counts towards banning it
+type Event string
+
+const (
+	EventSniffFailure Event = "sniff_failure"
+	EventUnknownHost  Event = "unknown_host"
+	EventLimited      Event = "limited"
+)
+
+// Events and bans which have expired are forgotten at most this often
+const sweepInterval = time.Minute
+
+// Ban is a client prefix which is not allowed to connect until Until
+type Ban struct {
+	Prefix netip.Prefix `json:"prefix"`
+	Until  time.Time    `json:"until"`
+	Reason string       `json:"reason"`
+}
+
+// Config holds the settings of a Manager
+type Config struct {
+	// Thresholds is the number of each event within Window which gets a client banned for Duration, 0 to ignore an event
+	Thresholds map[Event]int
+	Window     time.Duration
+	Duration   time.Duration
+	// IPv6Bits is the prefix length IPv6 clients are grouped by
+	IPv6Bits int
+	// File is where bans are persisted, if set
+	File string
+}
+
+// Manager counts events of clients and bans them if they exceed the thresholds.
+// A nil Manager never bans anyone.
+type Manager struct {
+	cfg Config
+
+	lock      sync.RWMutex
+	bans      map[netip.Prefix]*Ban
+	events    map[eventKey]*eventCount
+	lastSweep time.Time
+
+	// saveRequests wakes up the goroutine saving the file, it holds at most one request so they are coalesced
+	saveRequests chan struct{}
+}
+
+type eventKey struct {
+	prefix netip.Prefix
+	event  Event
+}
+
+type eventCount struct {
+	count int
+	start time.Time
+}
+
+// New creates a Manager, loading persisted bans from the file of cfg (if it exists)
+func New(cfg Config) (*Manager, error) {
+	m := &Manager{
+		cfg:       cfg,
+		bans:      make(map[netip.Prefix]*Ban),
+		events:    make(map[eventKey]*eventCount),
+		lastSweep: time.Now(),
+	}
+
+	if cfg.File == "" {
+		return m, nil
+	}
+	m.saveRequests = make(chan struct{}, 1)
+	go m.saver()
+
+	data, err := os.ReadFile(cfg.File)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var bans []*Ban
+	err = json.Unmarshal(data, &bans)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, ban := range bans {
+		if !ban.Until.After(now) || !ban.Prefix.IsValid() {
+			continue
+		}
+		// Bans are looked up by the prefix of the client, which changes along with IPv6Bits
+		ban.Prefix = m.key(ban.Prefix.Addr())
+		existing, ok := m.bans[ban.Prefix]
+		if !ok || ban.Until.After(existing.Until) {
+			m.bans[ban.Prefix] = ban
+		}
+	}
+	return m, nil
+}
+
+func (m *Manager) key(addr netip.Addr) netip.Prefix {
+	addr = addr.Unmap()
+	bits := addr.BitLen()
+	if addr.Is6() && m.cfg.IPv6Bits > 0 {
+		bits = m.cfg.IPv6Bits
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix
+}
+
+// Banned checks whether addr is currently banned
+func (m *Manager) Banned(addr netip.Addr) bool {
+	if m == nil || !addr.IsValid() {
+		return false
+	}
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	ban, ok := m.bans[m.key(addr)]
+	return ok && ban.Until.After(time.Now())
+}
+
+// Record counts event for addr and returns the new ban if this got it banned
+func (m *Manager) Record(addr netip.Addr, event Event) *Ban {
+	if m == nil || !addr.IsValid() {
+		return nil
+	}
+	threshold := m.cfg.Thresholds[event]
+	if threshold <= 0 {
+		return nil
+	}
+
+	prefix := m.key(addr)
+	now := time.Now()
+
+	m.lock.Lock()
+	m.sweep(now)
+
+	if ban, ok := m.bans[prefix]; ok && ban.Until.After(now) {
+		m.lock.Unlock()
+		return nil
+	}
+
+	key := eventKey{prefix: prefix, event: event}
+	count, ok := m.events[key]
+	if !ok || now.Sub(count.start) > m.cfg.Window {
+		count = &eventCount{start: now}
+		m.events[key] = count
+	}
+	count.count++
+	if count.count < threshold {
+		m.lock.Unlock()
+		return nil
+	}
+
+	delete(m.events, key)
+	ban := &Ban{
+		Prefix: prefix,
+		Until:  now.Add(m.cfg.Duration),
+		Reason: string(event),
+	}
+	m.bans[prefix] = ban
+	m.lock.Unlock()
+
+	m.save()
+	return ban
+}
+
+// List returns all current bans
+func (m *Manager) List() []Ban {
+	if m == nil {
+		return nil
+	}
+
+	now := time.Now()
+	m.lock.RLock()
+	bans := make([]Ban, 0, len(m.bans))
+	for _, ban := range m.bans {
+		if ban.Until.After(now) {
+			bans = append(bans, *ban)
+		}
+	}
+	m.lock.RUnlock()
+
+	slices.SortFunc(bans, func(a Ban, b Ban) int {
+		return a.Until.Compare(b.Until)
+	})
+	return bans
+}
+
+// Unban removes all bans overlapping prefix (so a single address unbans the prefix it is in), returning how many there were
+func (m *Manager) Unban(prefix netip.Prefix) int {
+	if m == nil {
+		return 0
+	}
+
+	removed := 0
+	m.lock.Lock()
+	for banPrefix := range m.bans {
+		if banPrefix.Overlaps(prefix) {
+			delete(m.bans, banPrefix)
+			removed++
+		}
+	}
+	m.lock.Unlock()
+
+	if removed > 0 {
+		m.save()
+	}
+	return removed
+}
+
+func (m *Manager) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < sweepInterval {
+		return
+	}
+	m.lastSweep = now
+
+	for key, count := range m.events {
+		if now.Sub(count.start) > m.cfg.Window {
+			delete(m.events, key)
+		}
+	}
+	for prefix, ban := range m.bans {
+		if !ban.Until.After(now) {
+			delete(m.bans, prefix)
+		}
+	}
+}
+
+// save persists the bans in the background, so connections do not wait for the file to be written
+func (m *Manager) save() {
+	if m.cfg.File == "" {
+		return
+	}
+
+	select {
+	case m.saveRequests <- struct{}{}:
+	default:
+		// A save is already pending, which will include the latest bans
+	}
+}
+
+func (m *Manager) saver() {
+	for range m.saveRequests {
+		m.saveFile()
+	}
+}
+
+func (m *Manager) saveFile() {
+	data, err := json.Marshal(m.List())
+	if err != nil {
+		logger.Error("Could not encode bans", "error", err)
+		return
+	}
+
+	// Write to a temporary file first, so a crash can not leave a truncated file behind
+	tmpFile := m.cfg.File + ".tmp"
+	err = os.WriteFile(tmpFile, data, 0600)
+	if err == nil {
+		err = os.Rename(tmpFile, m.cfg.File)
+	}
+	if err != nil {
+		// The bans still work, they are only lost on restart
+		logger.Error("Could not save bans", "file", m.cfg.File, "error", err)
+		_ = os.Remove(tmpFile)
+	}
+}
@@ -0,0 +1,137 @@
+package fingerprint
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gaukas/clienthellod"
+)
+
+const (
+	extensionServerName = 0x0000
+	extensionALPN       = 0x0010
+)
+
+// isGREASE checks for the reserved values (RFC 8701) clients randomly add to their ClientHello, which fingerprints ignore
+func isGREASE(value uint16) bool {
+	return value&0x0F0F == 0x0A0A && value>>8 == value&0xFF
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	return slices.DeleteFunc(slices.Clone(values), isGREASE)
+}
+
+func joinValues[T uint8 | uint16](values []T, format string, sep string) string {
+	parts := make([]string, 0, len(values))
+	for _, value := range values {
+		parts = append(parts, fmt.Sprintf(format, value))
+	}
+	return strings.Join(parts, sep)
+}
+
+// JA3 returns the JA3 fingerprint (MD5 hash as hex) of a ClientHello
+func JA3(ch *clienthellod.ClientHello) string {
+	ja3 := strings.Join([]string{
+		strconv.Itoa(int(ch.TLSHandshakeVersion)),
+		joinValues(withoutGREASE(ch.CipherSuites), "%d", "-"),
+		joinValues(withoutGREASE(ch.Extensions), "%d", "-"),
+		joinValues(withoutGREASE(ch.NamedGroupList), "%d", "-"),
+		joinValues(ch.ECPointFormatList, "%d", "-"),
+	}, ",")
+
+	hash := md5.Sum([]byte(ja3)) // skipcq: GSC-G401, JA3 is defined using MD5
+	return hex.EncodeToString(hash[:])
+}
+
+// JA4 returns the JA4 fingerprint of a ClientHello received over TCP or QUIC
+func JA4(ch *clienthellod.ClientHello, quic bool) string {
+	transport := "t"
+	if quic {
+		transport = "q"
+	}
+
+	sni := "i"
+	if ch.ServerName != "" {
+		sni = "d"
+	}
+
+	ciphers := withoutGREASE(ch.CipherSuites)
+	extensions := withoutGREASE(ch.Extensions)
+
+	a := fmt.Sprintf("%s%s%s%02d%02d%s", transport, ja4Version(ch), sni, min(len(ciphers), 99), min(len(extensions), 99), ja4ALPN(ch.ALPN))
+
+	slices.Sort(ciphers)
+	b := ja4Hash(joinValues(ciphers, "%04x", ","))
+
+	extensions = slices.DeleteFunc(extensions, func(ext uint16) bool {
+		return ext == extensionServerName || ext == extensionALPN
+	})
+	slices.Sort(extensions)
+	c := joinValues(extensions, "%04x", ",")
+	if len(extensions) > 0 && len(ch.SignatureSchemeList) > 0 {
+		c += "_" + joinValues(ch.SignatureSchemeList, "%04x", ",")
+	}
+
+	return fmt.Sprintf("%s_%s_%s", a, b, ja4Hash(c))
+}
+
+func ja4Version(ch *clienthellod.ClientHello) string {
+	version := ch.TLSHandshakeVersion
+	supportedVersions := withoutGREASE(ch.SupportedVersions)
+	if len(supportedVersions) > 0 {
+		version = slices.Max(supportedVersions)
+	}
+
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	case 0x0002:
+		return "s2"
+	case 0xFEFF:
+		return "d1"
+	case 0xFEFD:
+		return "d2"
+	case 0xFEFC:
+		return "d3"
+	}
+	return "00"
+}
+
+// ja4ALPN returns the first and last character of the first ALPN, or the hex digits at those ends if they are not alphanumeric
+func ja4ALPN(alpn []string) string {
+	if len(alpn) == 0 || alpn[0] == "" {
+		return "00"
+	}
+
+	first := alpn[0][0]
+	last := alpn[0][len(alpn[0])-1]
+	if isAlphanumeric(first) && isAlphanumeric(last) {
+		return string([]byte{first, last})
+	}
+	return string([]byte{hex.EncodeToString([]byte{first})[0], hex.EncodeToString([]byte{last})[1]})
+}
+
+func isAlphanumeric(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func ja4Hash(value string) string {
+	if value == "" {
+		return "000000000000"
+	}
+	hash := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(hash[:])[:12]
+}
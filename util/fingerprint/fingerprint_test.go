@@ -0,0 +1,133 @@
+package fingerprint
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/gaukas/clienthellod"
+)
+
+// The ClientHellos in testdata were captured from Google Chrome by the tests of clienthellod,
+// their JA4 fingerprints are the examples of Chrome in the JA4 documentation
+
+func TestTCP(t *testing.T) {
+	data, err := os.ReadFile("testdata/chrome.tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := clienthellod.ReadClientHello(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ch.ParseClientHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// JA3 string: 771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53,16-43-51-10-23-17513-11-65281-45-0-35-13-5-18-27-21,29-23-24,0
+	if got, want := JA3(ch), "a13fdd02ce16c3b87090673d3f1d7027"; got != want {
+		t.Errorf("JA3 is %s, want %s", got, want)
+	}
+	if got, want := JA4(ch, false), "t13d1516h2_8daaf6152771_e5627efa2ab1"; got != want {
+		t.Errorf("JA4 is %s, want %s", got, want)
+	}
+}
+
+func TestQUIC(t *testing.T) {
+	data, err := os.ReadFile("testdata/chrome.quic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cip, err := clienthellod.ParseQUICCIP(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := JA4(&cip.QCH.ClientHello, true), "q13d0310h3_55b375c5d22e_cd85d2d88918"; got != want {
+		t.Errorf("JA4 is %s, want %s", got, want)
+	}
+}
+
+// TestJA3Example builds a ClientHello matching the example of the JA3 documentation
+func TestJA3Example(t *testing.T) {
+	u16 := func(values ...uint16) []byte {
+		var b []byte
+		for _, value := range values {
+			b = binary.BigEndian.AppendUint16(b, value)
+		}
+		return b
+	}
+	withLen16 := func(b []byte) []byte {
+		return append(u16(uint16(len(b))), b...)
+	}
+
+	ciphers := u16(47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4)
+	var extensions []byte
+	extensions = append(extensions, u16(0)...)
+	extensions = append(extensions, withLen16(withLen16(append([]byte{0}, withLen16([]byte("example.com"))...)))...)
+	extensions = append(extensions, u16(10)...)
+	extensions = append(extensions, withLen16(withLen16(u16(23, 24, 25)))...)
+	extensions = append(extensions, u16(11)...)
+	extensions = append(extensions, withLen16([]byte{1, 0})...)
+
+	body := u16(0x0301)
+	body = append(body, make([]byte, 32)...) // random
+	body = append(body, 0)                   // session ID
+	body = append(body, withLen16(ciphers)...)
+	body = append(body, 1, 0) // compression methods
+	body = append(body, withLen16(extensions)...)
+
+	handshake := append([]byte{0x01, 0, byte(len(body) >> 8), byte(len(body))}, body...)
+	record := append([]byte{0x16, 0x03, 0x01}, withLen16(handshake)...)
+
+	ch, err := clienthellod.ReadClientHello(bytes.NewReader(record))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ch.ParseClientHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// JA3 string: 769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0
+	if got, want := JA3(ch), "ada70206e40642a3e4461f35503241d5"; got != want {
+		t.Errorf("JA3 is %s, want %s", got, want)
+	}
+}
+
+func TestJA4ALPN(t *testing.T) {
+	tests := []struct {
+		alpn []string
+		want string
+	}{
+		{nil, "00"},
+		{[]string{""}, "00"},
+		{[]string{"h2", "http/1.1"}, "h2"},
+		{[]string{"http/1.1"}, "h1"},
+		{[]string{"h3"}, "h3"},
+		{[]string{"a"}, "aa"},
+		{[]string{"\xab\xcd"}, "ad"},
+		{[]string{"h\xcd"}, "6d"},
+	}
+
+	for _, tt := range tests {
+		if got := ja4ALPN(tt.alpn); got != tt.want {
+			t.Errorf("ja4ALPN(%q) is %s, want %s", tt.alpn, got, tt.want)
+		}
+	}
+}
+
+func TestIsGREASE(t *testing.T) {
+	for _, value := range []uint16{0x0A0A, 0x1A1A, 0x5A5A, 0xFAFA} {
+		if !isGREASE(value) {
+			t.Errorf("0x%04X is GREASE", value)
+		}
+	}
+	for _, value := range []uint16{0x0A1A, 0x1301, 0x0000, 0xFFFF} {
+		if isGREASE(value) {
+			t.Errorf("0x%04X is not GREASE", value)
+		}
+	}
+}
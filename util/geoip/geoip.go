@@ -0,0 +1,125 @@
+package geoip
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Doridian/foxIngress/util/logging"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+var logger = logging.New("geoip")
+
+// ReloadInterval is how often the database file is checked for changes
+var ReloadInterval = time.Minute
+
+// Info is what we know about the location and network of an address
+type Info struct {
+	// Country is the ISO 3166-1 code of the country, empty if unknown
+	Country string
+	// ASN is the number of the autonomous system, 0 if unknown
+	ASN uint
+}
+
+// record holds the fields we use of both the country (GeoLite2-Country, GeoIP2-Country) and ASN (GeoLite2-ASN) databases
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	AutonomousSystemNumber uint `maxminddb:"autonomous_system_number"`
+}
+
+// Database is a MaxMind database file which is reloaded when it changes
+type Database struct {
+	path string
+
+	lock    sync.RWMutex
+	reader  *maxminddb.Reader
+	modTime time.Time
+}
+
+// Open opens the database at path and starts watching it for changes
+func Open(path string) (*Database, error) {
+	d := &Database{
+		path: path,
+	}
+	err := d.load()
+	if err != nil {
+		return nil, err
+	}
+
+	go d.watch()
+	return d, nil
+}
+
+func (d *Database) load() error {
+	stat, err := os.Stat(d.path)
+	if err != nil {
+		return err
+	}
+	reader, err := maxminddb.Open(d.path)
+	if err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	oldReader := d.reader
+	d.reader = reader
+	d.modTime = stat.ModTime()
+	d.lock.Unlock()
+
+	if oldReader != nil {
+		_ = oldReader.Close()
+	}
+	return nil
+}
+
+func (d *Database) watch() {
+	for {
+		time.Sleep(ReloadInterval)
+
+		stat, err := os.Stat(d.path)
+		if err != nil {
+			logger.Warn("Could not check GeoIP database", "file", d.path, "error", err)
+			continue
+		}
+
+		d.lock.RLock()
+		changed := !stat.ModTime().Equal(d.modTime)
+		d.lock.RUnlock()
+		if !changed {
+			continue
+		}
+
+		// Keep using the old database if the new one is broken (or only partially written)
+		err = d.load()
+		if err != nil {
+			logger.Warn("Could not reload GeoIP database", "file", d.path, "error", err)
+			continue
+		}
+		logger.Info("Reloaded GeoIP database", "file", d.path)
+	}
+}
+
+// Lookup returns the information the database has about addr
+func (d *Database) Lookup(addr netip.Addr) Info {
+	if d == nil || !addr.IsValid() {
+		return Info{}
+	}
+
+	var rec record
+	d.lock.RLock()
+	err := d.reader.Lookup(net.IP(addr.Unmap().AsSlice()), &rec)
+	d.lock.RUnlock()
+	if err != nil {
+		return Info{}
+	}
+
+	return Info{
+		Country: rec.Country.ISOCode,
+		ASN:     rec.AutonomousSystemNumber,
+	}
+}
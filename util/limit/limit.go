@@ -0,0 +1,158 @@
+package limit
+
+import (
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+var ErrRateLimited = errors.New("connection rate limit exceeded")
+var ErrTooManyConnections = errors.New("too many concurrent connections")
+
+// Clients which have no connections open and a full bucket are forgotten at most this often
+const sweepInterval = time.Minute
+
+// Limiter limits the rate of new connections (using a token bucket) and the number of concurrent connections per client.
+// IPv6 clients are grouped by prefix, as they can usually pick from a whole /64 (or more) of addresses.
+// A nil Limiter allows everything.
+type Limiter struct {
+	rate          float64
+	burst         float64
+	maxConcurrent int
+	ipv6Bits      int
+
+	lock      sync.Mutex
+	clients   map[netip.Prefix]*client
+	lastSweep time.Time
+}
+
+type client struct {
+	tokens float64
+	last   time.Time
+	active int
+}
+
+// New creates a Limiter allowing rate new connections per second (with bursts of up to burst connections)
+// and maxConcurrent open connections per client, a value of 0 disables the respective limit
+func New(rate float64, burst int, maxConcurrent int, ipv6Bits int) *Limiter {
+	if burst < 1 {
+		burst = max(1, int(rate))
+	}
+	return &Limiter{
+		rate:          rate,
+		burst:         float64(burst),
+		maxConcurrent: maxConcurrent,
+		ipv6Bits:      ipv6Bits,
+		clients:       make(map[netip.Prefix]*client),
+		lastSweep:     time.Now(),
+	}
+}
+
+// Acquire counts a new connection from addr, the returned function must be called once it is closed
+func (l *Limiter) Acquire(addr netip.Addr) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	key := l.key(addr)
+	now := time.Now()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.sweep(now)
+
+	c, ok := l.clients[key]
+	if !ok {
+		c = &client{
+			tokens: l.burst,
+			last:   now,
+		}
+		l.clients[key] = c
+	}
+
+	if l.maxConcurrent > 0 && c.active >= l.maxConcurrent {
+		return nil, ErrTooManyConnections
+	}
+
+	if l.rate > 0 {
+		c.refill(now, l.rate, l.burst)
+		if c.tokens < 1 {
+			return nil, ErrRateLimited
+		}
+		c.tokens--
+	}
+
+	c.active++
+	released := false
+	return func() {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		if released {
+			return
+		}
+		released = true
+		c.active--
+	}, nil
+}
+
+// SameSettings returns whether both limiters apply the same limits (both being nil counts as the same)
+func (l *Limiter) SameSettings(other *Limiter) bool {
+	if l == nil || other == nil {
+		return l == other
+	}
+	return l.rate == other.rate && l.burst == other.burst && l.maxConcurrent == other.maxConcurrent && l.ipv6Bits == other.ipv6Bits
+}
+
+func (l *Limiter) key(addr netip.Addr) netip.Prefix {
+	addr = addr.Unmap()
+	bits := addr.BitLen()
+	if addr.Is6() && l.ipv6Bits > 0 {
+		bits = l.ipv6Bits
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		// Invalid addresses (such as unix sockets) all share one bucket
+		return netip.Prefix{}
+	}
+	return prefix
+}
+
+func (c *client) refill(now time.Time, rate float64, burst float64) {
+	c.tokens = min(burst, c.tokens+now.Sub(c.last).Seconds()*rate)
+	c.last = now
+}
+
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for key, c := range l.clients {
+		if c.active > 0 {
+			continue
+		}
+		if l.rate > 0 {
+			c.refill(now, l.rate, l.burst)
+			if c.tokens < l.burst {
+				continue
+			}
+		}
+		delete(l.clients, key)
+	}
+}
+
+// Reason returns a short description of why Acquire failed, for use in metrics
+func Reason(err error) string {
+	switch {
+	case errors.Is(err, ErrRateLimited):
+		return "rate"
+	case errors.Is(err, ErrTooManyConnections):
+		return "concurrency"
+	case errors.Is(err, ErrNoSlots):
+		return "max_connections"
+	}
+	return "other"
+}
@@ -0,0 +1,68 @@
+package limit
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrNoSlots = errors.New("maximum number of connections reached")
+
+// Semaphore limits the number of connections open at the same time.
+// New connections wait for up to the queue timeout for a free slot.
+// A nil Semaphore allows everything.
+type Semaphore struct {
+	slots        chan struct{}
+	queueTimeout time.Duration
+}
+
+// NewSemaphore creates a Semaphore allowing maxConnections connections, which queues new ones for up to queueTimeout
+func NewSemaphore(maxConnections int, queueTimeout time.Duration) *Semaphore {
+	return &Semaphore{
+		slots:        make(chan struct{}, maxConnections),
+		queueTimeout: queueTimeout,
+	}
+}
+
+// Acquire takes a slot, the returned function must be called once the connection is closed
+func (s *Semaphore) Acquire() (func(), error) {
+	if s == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+		return s.releaser(), nil
+	default:
+	}
+
+	if s.queueTimeout <= 0 {
+		return nil, ErrNoSlots
+	}
+
+	timer := time.NewTimer(s.queueTimeout)
+	defer timer.Stop()
+	select {
+	case s.slots <- struct{}{}:
+		return s.releaser(), nil
+	case <-timer.C:
+		return nil, ErrNoSlots
+	}
+}
+
+// SameSettings returns whether both semaphores have the same number of slots and queue timeout (both being nil counts as the same)
+func (s *Semaphore) SameSettings(other *Semaphore) bool {
+	if s == nil || other == nil {
+		return s == other
+	}
+	return cap(s.slots) == cap(other.slots) && s.queueTimeout == other.queueTimeout
+}
+
+func (s *Semaphore) releaser() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-s.slots
+		})
+	}
+}
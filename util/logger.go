@@ -0,0 +1,5 @@
+package util
+
+import "github.com/Doridian/foxIngress/util/logging"
+
+var logger = logging.New("main")
@@ -0,0 +1,174 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	FORMAT_TEXT = "text"
+	FORMAT_JSON = "json"
+)
+
+var level = new(slog.LevelVar)
+
+var lock sync.Mutex
+var root slog.Handler = newRootHandler(os.Stderr, FORMAT_TEXT)
+var subsystems []*subsystemHandler
+
+// generation is increased by Configure, so derived handlers know to resolve their handler again
+var generation atomic.Uint64
+
+func init() {
+	// Send everything logged with the standard log package (by us or libraries) through our handlers as well
+	slog.SetDefault(New("main"))
+}
+
+func newRootHandler(w io.Writer, format string) slog.Handler {
+	opts := &slog.HandlerOptions{
+		Level: level,
+	}
+	if format == FORMAT_JSON {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// ParseLevel parses a level name (debug, info, warn or error)
+func ParseLevel(name string) (slog.Level, error) {
+	var lvl slog.Level
+	err := lvl.UnmarshalText([]byte(name))
+	return lvl, err
+}
+
+// Configure sets the minimum level and the format (text or json) of all loggers
+func Configure(lvl slog.Level, format string) error {
+	if format != FORMAT_TEXT && format != FORMAT_JSON {
+		return fmt.Errorf("invalid log format %q", format)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	level.Set(lvl)
+	root = newRootHandler(os.Stderr, format)
+	for _, h := range subsystems {
+		h.update(root)
+	}
+	generation.Add(1)
+	return nil
+}
+
+// New returns the logger of a subsystem, which (like loggers derived from it with With) follows later calls to Configure
+func New(subsystem string) *slog.Logger {
+	lock.Lock()
+	defer lock.Unlock()
+
+	h := &subsystemHandler{
+		subsystem: subsystem,
+	}
+	h.update(root)
+	subsystems = append(subsystems, h)
+	return slog.New(h)
+}
+
+// Fatal logs msg as an error and exits, like log.Fatal
+func Fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+type subsystemHandler struct {
+	subsystem string
+	current   atomic.Pointer[slog.Handler]
+}
+
+func (h *subsystemHandler) update(root slog.Handler) {
+	handler := root.WithAttrs([]slog.Attr{slog.String("subsystem", h.subsystem)})
+	h.current.Store(&handler)
+}
+
+func (h *subsystemHandler) handler() slog.Handler {
+	return *h.current.Load()
+}
+
+func (h *subsystemHandler) Enabled(ctx context.Context, lvl slog.Level) bool {
+	return h.handler().Enabled(ctx, lvl)
+}
+
+func (h *subsystemHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.handler().Handle(ctx, r)
+}
+
+func (h *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return newDerivedHandler(h, func(parent slog.Handler) slog.Handler {
+		return parent.WithAttrs(attrs)
+	})
+}
+
+func (h *subsystemHandler) WithGroup(name string) slog.Handler {
+	return newDerivedHandler(h, func(parent slog.Handler) slog.Handler {
+		return parent.WithGroup(name)
+	})
+}
+
+type resolver interface {
+	handler() slog.Handler
+}
+
+// derivedHandler adds attributes or a group to the current handler of its parent,
+// which it derives again (only) after Configure was called
+type derivedHandler struct {
+	parent resolver
+	derive func(slog.Handler) slog.Handler
+	cached atomic.Pointer[derivedCache]
+}
+
+type derivedCache struct {
+	generation uint64
+	handler    slog.Handler
+}
+
+func newDerivedHandler(parent resolver, derive func(slog.Handler) slog.Handler) *derivedHandler {
+	return &derivedHandler{
+		parent: parent,
+		derive: derive,
+	}
+}
+
+func (h *derivedHandler) handler() slog.Handler {
+	gen := generation.Load()
+	cached := h.cached.Load()
+	if cached != nil && cached.generation == gen {
+		return cached.handler
+	}
+
+	handler := h.derive(h.parent.handler())
+	h.cached.Store(&derivedCache{generation: gen, handler: handler})
+	return handler
+}
+
+func (h *derivedHandler) Enabled(ctx context.Context, lvl slog.Level) bool {
+	return h.handler().Enabled(ctx, lvl)
+}
+
+func (h *derivedHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.handler().Handle(ctx, r)
+}
+
+func (h *derivedHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return newDerivedHandler(h, func(parent slog.Handler) slog.Handler {
+		return parent.WithAttrs(attrs)
+	})
+}
+
+func (h *derivedHandler) WithGroup(name string) slog.Handler {
+	return newDerivedHandler(h, func(parent slog.Handler) slog.Handler {
+		return parent.WithGroup(name)
+	})
+}
@@ -0,0 +1,55 @@
+//go:build linux
+
+package util
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+
+	"golang.org/x/sys/unix"
+)
+
+// OriginalDestination returns the destination a connection had before it was redirected to us by netfilter (REDIRECT or DNAT)
+func OriginalDestination(conn *net.TCPConn) (netip.AddrPort, error) {
+	localAddr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return netip.AddrPort{}, errors.New("connection has no TCP local address")
+	}
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	var dst netip.AddrPort
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		// IPv4 clients of dual-stack sockets have IPv4-mapped addresses, but are tracked as IPv4 by conntrack
+		if localAddr.AddrPort().Addr().Unmap().Is4() {
+			// struct sockaddr_in fits into the larger struct ipv6_mreq this returns
+			var mreq *unix.IPv6Mreq
+			mreq, sockErr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+			if sockErr != nil {
+				return
+			}
+			port := binary.BigEndian.Uint16(mreq.Multiaddr[2:4])
+			dst = netip.AddrPortFrom(netip.AddrFrom4([4]byte(mreq.Multiaddr[4:8])), port)
+		} else {
+			// struct sockaddr_in6 is the first member of struct ip6_mtuinfo
+			var info *unix.IPv6MTUInfo
+			info, sockErr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, unix.SO_ORIGINAL_DST)
+			if sockErr != nil {
+				return
+			}
+			// The port is in network byte order
+			port := binary.BigEndian.Uint16(binary.NativeEndian.AppendUint16(nil, info.Addr.Port))
+			dst = netip.AddrPortFrom(netip.AddrFrom16(info.Addr.Addr).Unmap(), port)
+		}
+	})
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return dst, sockErr
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package util
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+func OriginalDestination(conn *net.TCPConn) (netip.AddrPort, error) {
+	return netip.AddrPort{}, errors.New("reading the original destination is only supported on Linux")
+}
@@ -3,31 +3,30 @@
 package util
 
 import (
-	"log"
 	"os"
 	"strconv"
 	"syscall"
 )
 
-func DropPrivs() {
+func DropPrivs(keepNetAdmin bool) {
 	uid, _ := strconv.Atoi(os.Getenv("PUID"))
 	gid, _ := strconv.Atoi(os.Getenv("PGID"))
 
-	log.Printf("Startup IDs: UID = %d, GID = %d", syscall.Getuid(), syscall.Getgid())
+	logger.Info("Startup IDs", "uid", syscall.Getuid(), "gid", syscall.Getgid())
 
 	if gid > 0 {
 		err := syscall.Setregid(gid, gid)
 		if err != nil {
-			log.Printf("Error dropping GID: %v", err)
+			logger.Error("Error dropping GID", "gid", gid, "error", err)
 		}
 	}
 
 	if uid > 0 {
 		err := syscall.Setreuid(uid, uid)
 		if err != nil {
-			log.Printf("Error dropping UID: %v", err)
+			logger.Error("Error dropping UID", "uid", uid, "error", err)
 		}
 	}
 
-	log.Printf("Runtime IDs: UID = %d, GID = %d", syscall.Getuid(), syscall.Getgid())
+	logger.Info("Runtime IDs", "uid", syscall.Getuid(), "gid", syscall.Getgid())
 }
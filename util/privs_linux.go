@@ -3,31 +3,75 @@
 package util
 
 import (
-	"log"
 	"os"
 	"strconv"
 	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
 )
 
-func DropPrivs() {
+// DropPrivs switches to PUID and PGID. With keepNetAdmin, CAP_NET_ADMIN is kept (and all other capabilities dropped),
+// as transparent backends need it for every connection.
+func DropPrivs(keepNetAdmin bool) {
 	uid, _ := strconv.Atoi(os.Getenv("PUID"))
 	gid, _ := strconv.Atoi(os.Getenv("PGID"))
 
-	log.Printf("Startup IDs: UID = %d, GID = %d", syscall.Getuid(), syscall.Getgid())
+	logger.Info("Startup IDs", "uid", syscall.Getuid(), "gid", syscall.Getgid())
+
+	keepCaps := keepNetAdmin && uid > 0 && syscall.Getuid() == 0
+	if keepCaps {
+		err := allThreadsPrctl(unix.PR_SET_KEEPCAPS, 1)
+		if err != nil {
+			logger.Error("Error keeping capabilities", "error", err)
+			keepCaps = false
+		}
+	}
 
 	if gid > 0 {
 		err := syscall.Setresgid(gid, gid, gid)
 		if err != nil {
-			log.Printf("Error dropping GID: %v", err)
+			logger.Error("Error dropping GID", "gid", gid, "error", err)
 		}
 	}
 
 	if uid > 0 {
 		err := syscall.Setresuid(uid, uid, uid)
 		if err != nil {
-			log.Printf("Error dropping UID: %v", err)
+			logger.Error("Error dropping UID", "uid", uid, "error", err)
+		}
+	}
+
+	if keepCaps {
+		err := keepOnlyCapability(unix.CAP_NET_ADMIN)
+		if err != nil {
+			logger.Error("Error keeping CAP_NET_ADMIN", "error", err)
 		}
+		_ = allThreadsPrctl(unix.PR_SET_KEEPCAPS, 0)
+	}
+
+	logger.Info("Runtime IDs", "uid", syscall.Getuid(), "gid", syscall.Getgid(), "net_admin", keepCaps)
+}
+
+// allThreadsPrctl calls prctl on all threads, as Setresuid does, which fails if cgo is used
+func allThreadsPrctl(option uintptr, arg uintptr) error {
+	_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, option, arg, 0)
+	if errno != 0 {
+		return errno
 	}
+	return nil
+}
 
-	log.Printf("Runtime IDs: UID = %d, GID = %d", syscall.Getuid(), syscall.Getgid())
+// keepOnlyCapability makes capability the only permitted and effective capability of all threads
+func keepOnlyCapability(capability uintptr) error {
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	data[capability/32].Permitted = 1 << (capability % 32)
+	data[capability/32].Effective = 1 << (capability % 32)
+
+	_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
 }
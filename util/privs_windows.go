@@ -2,5 +2,5 @@
 
 package util
 
-func DropPrivs() {
+func DropPrivs(keepNetAdmin bool) {
 }
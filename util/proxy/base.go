@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"net"
 	"net/netip"
 )
@@ -11,6 +12,7 @@ import (
 type Transport = byte
 
 const (
+	ProxyUnspec Transport = 0b00000000
 	ProxyStream Transport = 0b00000001 // TCP
 	ProxyDgram  Transport = 0b00000010 // UDP
 
@@ -24,54 +26,127 @@ const (
 	addrLenIPv6 = (net.IPv6len + 2) * 2
 
 	protoVersion = 0b00100000 // 2
-	protoCommand = 0b00000001 // PROXY
+
+	CommandLocal = 0b00000000
+	CommandProxy = 0b00000001
+
+	// type + length
+	tlvHeaderLen = 3
+	crc32cLen    = 4
+)
+
+const (
+	TLVTypeALPN      = 0x01
+	TLVTypeAuthority = 0x02
+	TLVTypeCRC32C    = 0x03
+	TLVTypeNoop      = 0x04
+	TLVTypeUniqueID  = 0x05
+
+	// Types in this range are reserved for custom (vendor specific) use
+	TLVTypeMinCustom = 0xE0
+	TLVTypeMaxCustom = 0xEF
+
+	// MaxUniqueIDLen is the longest value of a TLVTypeUniqueID TLV allowed by the spec
+	MaxUniqueIDLen = 128
 )
 
-var header = [13]byte{
-	0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A, // Signature
-	protoVersion | protoCommand,
+// TLV is an additional value carried in a version 2 header.
+// The value of a TLVTypeCRC32C TLV is ignored, it is computed over the whole header instead.
+type TLV struct {
+	Type  byte
+	Value []byte
 }
 
-func MakePayload(proto Transport, srcAddr netip.AddrPort, dstAddr netip.AddrPort) (data []byte, err error) {
-	maxAddrLen := net.IPv4len
-	if srcAddr.Addr().Is6() || dstAddr.Addr().Is6() {
-		maxAddrLen = net.IPv6len
-	}
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
 
-	outBuf := bytes.Buffer{}
-	outBuf.Write(header[:])
+var signature = [12]byte{
+	0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A,
+}
 
-	switch maxAddrLen {
-	case net.IPv4len:
-		outBuf.WriteByte(AFIPv4 | proto)
-		if err = binary.Write(&outBuf, binary.BigEndian, uint16(addrLenIPv4)); err != nil {
-			return
+func tlvsLen(tlvs []TLV) int {
+	length := 0
+	for _, tlv := range tlvs {
+		length += tlvHeaderLen
+		if tlv.Type == TLVTypeCRC32C {
+			length += crc32cLen
+		} else {
+			length += len(tlv.Value)
 		}
+	}
+	return length
+}
 
-		addr := srcAddr.Addr().As4()
-		outBuf.Write(addr[:])
-		addr = dstAddr.Addr().As4()
-		outBuf.Write(addr[:])
-	case net.IPv6len:
-		outBuf.WriteByte(AFIPv6 | proto)
-		if err = binary.Write(&outBuf, binary.BigEndian, uint16(addrLenIPv6)); err != nil {
-			return
-		}
+// MakePayload builds a binary (version 2) PROXY protocol header.
+// Mixed IPv4 and IPv6 addresses are sent as IPv6 (IPv4-mapped), addresses that are not valid IPs produce a LOCAL header.
+func MakePayload(proto Transport, srcAddr netip.AddrPort, dstAddr netip.AddrPort, tlvs []TLV) ([]byte, error) {
+	if !srcAddr.IsValid() || !dstAddr.IsValid() || proto == ProxyUnspec {
+		return MakeLocalPayload(tlvs)
+	}
 
-		addr := srcAddr.Addr().As16()
-		outBuf.Write(addr[:])
-		addr = dstAddr.Addr().As16()
-		outBuf.Write(addr[:])
-	default:
-		return nil, fmt.Errorf("unknown address family len %d", maxAddrLen)
+	srcIP := srcAddr.Addr().Unmap()
+	dstIP := dstAddr.Addr().Unmap()
+
+	addrs := bytes.Buffer{}
+	family := byte(AFIPv4)
+	if srcIP.Is4() && dstIP.Is4() {
+		addr := srcIP.As4()
+		addrs.Write(addr[:])
+		addr = dstIP.As4()
+		addrs.Write(addr[:])
+	} else {
+		family = AFIPv6
+		addr := srcIP.As16()
+		addrs.Write(addr[:])
+		addr = dstIP.As16()
+		addrs.Write(addr[:])
 	}
+	addrs.Write(binary.BigEndian.AppendUint16(nil, srcAddr.Port()))
+	addrs.Write(binary.BigEndian.AppendUint16(nil, dstAddr.Port()))
+
+	return makePayload(CommandProxy, family|proto, addrs.Bytes(), tlvs)
+}
 
-	if err = binary.Write(&outBuf, binary.BigEndian, srcAddr.Port()); err != nil {
-		return
+// MakeLocalPayload builds a binary (version 2) PROXY protocol header with the LOCAL command and no addresses,
+// which tells the receiver to use the real endpoints of the connection
+func MakeLocalPayload(tlvs []TLV) ([]byte, error) {
+	return makePayload(CommandLocal, AFUnset|ProxyUnspec, nil, tlvs)
+}
+
+func makePayload(command byte, familyTransport byte, addrs []byte, tlvs []TLV) ([]byte, error) {
+	length := len(addrs) + tlvsLen(tlvs)
+	if length > 0xFFFF {
+		return nil, fmt.Errorf("PROXY protocol v2 header too long (%d bytes)", length)
 	}
-	if err = binary.Write(&outBuf, binary.BigEndian, dstAddr.Port()); err != nil {
-		return
+	for _, tlv := range tlvs {
+		if tlv.Type == TLVTypeUniqueID && len(tlv.Value) > MaxUniqueIDLen {
+			return nil, fmt.Errorf("PROXY protocol unique ID too long (%d bytes, at most %d allowed)", len(tlv.Value), MaxUniqueIDLen)
+		}
 	}
 
-	return outBuf.Bytes(), nil
+	outBuf := bytes.Buffer{}
+	outBuf.Write(signature[:])
+	outBuf.WriteByte(protoVersion | command)
+	outBuf.WriteByte(familyTransport)
+	outBuf.Write(binary.BigEndian.AppendUint16(nil, uint16(length)))
+	outBuf.Write(addrs)
+
+	crcOffset := -1
+	for _, tlv := range tlvs {
+		value := tlv.Value
+		if tlv.Type == TLVTypeCRC32C {
+			value = make([]byte, crc32cLen)
+			crcOffset = outBuf.Len() + tlvHeaderLen
+		}
+
+		outBuf.WriteByte(tlv.Type)
+		outBuf.Write(binary.BigEndian.AppendUint16(nil, uint16(len(value))))
+		outBuf.Write(value)
+	}
+
+	data := outBuf.Bytes()
+	if crcOffset >= 0 {
+		// The checksum is computed over the whole header with the checksum field itself set to zero
+		binary.BigEndian.PutUint32(data[crcOffset:], crc32.Checksum(data, crc32cTable))
+	}
+	return data, nil
 }
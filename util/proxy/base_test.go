@@ -0,0 +1,31 @@
+package proxy_test
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+
+	"github.com/Doridian/foxIngress/util/proxy"
+)
+
+func TestMakePayloadUniqueIDLen(t *testing.T) {
+	src := netip.MustParseAddrPort("192.0.2.1:1234")
+	dst := netip.MustParseAddrPort("192.0.2.2:443")
+
+	tlvs := []proxy.TLV{{Type: proxy.TLVTypeUniqueID, Value: bytes.Repeat([]byte{'a'}, proxy.MaxUniqueIDLen)}}
+	_, err := proxy.MakePayload(proxy.ProxyStream, src, dst, tlvs)
+	if err != nil {
+		t.Errorf("Unique ID of %d bytes rejected: %v", proxy.MaxUniqueIDLen, err)
+	}
+
+	tlvs[0].Value = append(tlvs[0].Value, 'a')
+	_, err = proxy.MakePayload(proxy.ProxyStream, src, dst, tlvs)
+	if err == nil {
+		t.Errorf("Unique ID of %d bytes accepted", proxy.MaxUniqueIDLen+1)
+	}
+
+	_, err = proxy.MakeLocalPayload(tlvs)
+	if err == nil {
+		t.Errorf("Unique ID of %d bytes accepted for LOCAL header", proxy.MaxUniqueIDLen+1)
+	}
+}
@@ -1,7 +1,6 @@
 package proxy
 
 import (
-	"fmt"
 	"io"
 	"net"
 	"net/netip"
@@ -12,27 +11,39 @@ type Addressable interface {
 	RemoteAddr() net.Addr
 }
 
-func getIP(addr net.Addr) (netip.AddrPort, Transport, error) {
+// getIP returns the address and transport of addr, or an invalid address if it is not an IP address (such as a unix socket)
+func getIP(addr net.Addr) (netip.AddrPort, Transport) {
 	switch ipAddr := addr.(type) {
 	case *net.UDPAddr:
-		return ipAddr.AddrPort(), ProxyDgram, nil
+		return ipAddr.AddrPort(), ProxyDgram
 	case *net.TCPAddr:
-		return ipAddr.AddrPort(), ProxyStream, nil
+		return ipAddr.AddrPort(), ProxyStream
 	}
-	return netip.AddrPort{}, 0, fmt.Errorf("unsupported address type: %T (%v)", addr, addr)
+	return netip.AddrPort{}, ProxyUnspec
 }
 
-func WriteConn(clientConn Addressable, backendConn io.Writer) error {
-	remoteAddr, proto, err := getIP(clientConn.RemoteAddr())
-	if err != nil {
-		return err
-	}
-	localAddr, _, err := getIP(clientConn.LocalAddr())
+// MakeConnPayload builds a binary (version 2) PROXY protocol header for clientConn
+func MakeConnPayload(clientConn Addressable, tlvs []TLV) ([]byte, error) {
+	remoteAddr, proto := getIP(clientConn.RemoteAddr())
+	localAddr, _ := getIP(clientConn.LocalAddr())
+
+	return MakePayload(proto, remoteAddr, localAddr, tlvs)
+}
+
+func WriteConn(clientConn Addressable, backendConn io.Writer, tlvs []TLV) error {
+	payload, err := MakeConnPayload(clientConn, tlvs)
 	if err != nil {
 		return err
 	}
+	_, err = backendConn.Write(payload)
+	return err
+}
+
+func WriteConnV1(clientConn Addressable, backendConn io.Writer) error {
+	remoteAddr, proto := getIP(clientConn.RemoteAddr())
+	localAddr, _ := getIP(clientConn.LocalAddr())
 
-	payload, err := MakePayload(proto, remoteAddr, localAddr)
+	payload, err := MakePayloadV1(proto, remoteAddr, localAddr)
 	if err != nil {
 		return err
 	}
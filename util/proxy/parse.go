@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+const (
+	v1Prefix      = "PROXY "
+	v2MinLength   = len(signature) + 4 // signature + version/command + family/transport + length
+	addrLenUnix   = 108 * 2
+	versionMask   = 0b11110000
+	commandMask   = 0b00001111
+	familyMask    = 0b11110000
+	transportMask = 0b00001111
+)
+
+var ErrNoHeader = errors.New("no PROXY protocol header")
+
+// Header is a parsed PROXY protocol header.
+// Source and Destination are only valid if the sender provided IP addresses (Command is CommandProxy and the family is IPv4 or IPv6).
+type Header struct {
+	Version     int
+	Command     byte
+	Transport   Transport
+	Source      netip.AddrPort
+	Destination netip.AddrPort
+	TLVs        []TLV
+}
+
+// Parse parses a version 1 or 2 header at the start of data and returns it along with its length
+func Parse(data []byte) (*Header, int, error) {
+	if bytes.HasPrefix(data, []byte(v1Prefix)) {
+		end := bytes.Index(data, []byte("\r\n"))
+		if end < 0 || end+2 > v1MaxLength {
+			return nil, 0, errors.New("unterminated PROXY protocol v1 header")
+		}
+		hdr, err := parseV1(data[:end])
+		return hdr, end + 2, err
+	}
+
+	if len(data) < v2MinLength || !bytes.Equal(data[:len(signature)], signature[:]) {
+		return nil, 0, ErrNoHeader
+	}
+	length := v2MinLength + int(binary.BigEndian.Uint16(data[v2MinLength-2:]))
+	if len(data) < length {
+		return nil, 0, errors.New("truncated PROXY protocol v2 header")
+	}
+	hdr, err := parseV2(data[:length])
+	return hdr, length, err
+}
+
+// Read reads a version 1 or 2 header from r, consuming exactly the bytes of the header
+func Read(r *bufio.Reader) (*Header, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch first[0] {
+	case v1Prefix[0]:
+		line, err := r.ReadSlice('\n')
+		if err != nil {
+			return nil, err
+		}
+		hdr, _, err := Parse(line)
+		return hdr, err
+	case signature[0]:
+		fixed, err := r.Peek(v2MinLength)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(fixed[:len(signature)], signature[:]) {
+			return nil, ErrNoHeader
+		}
+		// Headers can be up to 64 KiB, more than the buffer of the reader can peek
+		data := make([]byte, v2MinLength+int(binary.BigEndian.Uint16(fixed[v2MinLength-2:])))
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return nil, err
+		}
+		hdr, _, err := Parse(data)
+		return hdr, err
+	}
+	return nil, ErrNoHeader
+}
+
+func parseV1(line []byte) (*Header, error) {
+	fields := strings.Split(string(line), " ")
+	hdr := &Header{
+		Version:   1,
+		Command:   CommandLocal,
+		Transport: ProxyStream,
+	}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return hdr, nil
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 header %q", line)
+	}
+
+	src, err := parseV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseV1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+
+	hdr.Command = CommandProxy
+	hdr.Source = src
+	hdr.Destination = dst
+	return hdr, nil
+}
+
+func parseV1Addr(family string, ip string, port string) (netip.AddrPort, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	switch family {
+	case "TCP4":
+		if !addr.Is4() {
+			return netip.AddrPort{}, fmt.Errorf("invalid IPv4 address %s", ip)
+		}
+	case "TCP6":
+		if !addr.Is6() {
+			return netip.AddrPort{}, fmt.Errorf("invalid IPv6 address %s", ip)
+		}
+	default:
+		return netip.AddrPort{}, fmt.Errorf("invalid PROXY protocol v1 family %s", family)
+	}
+
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(addr, uint16(portNum)), nil
+}
+
+func parseV2(data []byte) (*Header, error) {
+	verCmd := data[len(signature)]
+	if verCmd&versionMask != protoVersion {
+		return nil, fmt.Errorf("unsupported PROXY protocol version 0x%02X", verCmd&versionMask)
+	}
+
+	hdr := &Header{
+		Version:   2,
+		Command:   verCmd & commandMask,
+		Transport: data[len(signature)+1] & transportMask,
+	}
+	if hdr.Command != CommandLocal && hdr.Command != CommandProxy {
+		return nil, fmt.Errorf("unsupported PROXY protocol command 0x%02X", hdr.Command)
+	}
+
+	payload := data[v2MinLength:]
+	addrLen := 0
+	switch data[len(signature)+1] & familyMask {
+	case AFIPv4:
+		addrLen = addrLenIPv4
+	case AFIPv6:
+		addrLen = addrLenIPv6
+	case AFUnix:
+		addrLen = addrLenUnix
+	}
+	if len(payload) < addrLen {
+		return nil, errors.New("truncated PROXY protocol v2 addresses")
+	}
+
+	if hdr.Command == CommandProxy && addrLen != addrLenUnix && addrLen > 0 {
+		ipLen := net.IPv4len
+		if addrLen == addrLenIPv6 {
+			ipLen = net.IPv6len
+		}
+		srcIP, _ := netip.AddrFromSlice(payload[:ipLen])
+		dstIP, _ := netip.AddrFromSlice(payload[ipLen : ipLen*2])
+		hdr.Source = netip.AddrPortFrom(srcIP, binary.BigEndian.Uint16(payload[ipLen*2:]))
+		hdr.Destination = netip.AddrPortFrom(dstIP, binary.BigEndian.Uint16(payload[ipLen*2+2:]))
+	}
+
+	tlvOffset := v2MinLength + addrLen
+	tlvs := payload[addrLen:]
+	for len(tlvs) > 0 {
+		if len(tlvs) < tlvHeaderLen {
+			return nil, errors.New("truncated PROXY protocol v2 TLV")
+		}
+		valueLen := int(binary.BigEndian.Uint16(tlvs[1:tlvHeaderLen]))
+		if len(tlvs) < tlvHeaderLen+valueLen {
+			return nil, errors.New("truncated PROXY protocol v2 TLV")
+		}
+		tlv := TLV{
+			Type:  tlvs[0],
+			Value: tlvs[tlvHeaderLen : tlvHeaderLen+valueLen],
+		}
+		if tlv.Type == TLVTypeCRC32C {
+			err := verifyCRC32C(data, tlvOffset+tlvHeaderLen, tlv.Value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		hdr.TLVs = append(hdr.TLVs, tlv)
+
+		tlvOffset += tlvHeaderLen + valueLen
+		tlvs = tlvs[tlvHeaderLen+valueLen:]
+	}
+
+	return hdr, nil
+}
+
+func verifyCRC32C(data []byte, offset int, value []byte) error {
+	if len(value) != crc32cLen {
+		return errors.New("invalid PROXY protocol v2 CRC32C TLV length")
+	}
+
+	zeroed := bytes.Clone(data)
+	copy(zeroed[offset:offset+crc32cLen], make([]byte, crc32cLen))
+	if crc32.Checksum(zeroed, crc32cTable) != binary.BigEndian.Uint32(value) {
+		return errors.New("PROXY protocol v2 CRC32C mismatch")
+	}
+	return nil
+}
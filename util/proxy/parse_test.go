@@ -0,0 +1,32 @@
+package proxy_test
+
+import (
+	"bufio"
+	"bytes"
+	"net/netip"
+	"testing"
+
+	"github.com/Doridian/foxIngress/util/proxy"
+)
+
+func TestReadLargeHeader(t *testing.T) {
+	tlvs := []proxy.TLV{{Type: proxy.TLVTypeMinCustom, Value: bytes.Repeat([]byte{0x42}, 20000)}}
+	payload, err := proxy.MakePayload(proxy.ProxyStream, netip.MustParseAddrPort("192.0.2.1:1234"), netip.MustParseAddrPort("192.0.2.2:443"), tlvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(bytes.NewReader(append(payload, "rest"...)))
+	hdr, err := proxy.Read(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hdr.TLVs) != 1 || !bytes.Equal(hdr.TLVs[0].Value, tlvs[0].Value) {
+		t.Errorf("TLVs were not read back")
+	}
+
+	rest, _ := r.Peek(4)
+	if string(rest) != "rest" {
+		t.Errorf("Read consumed %q instead of only the header", rest)
+	}
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"bytes"
+	"math/rand"
+	"net/netip"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+const (
+	familyIPv4 = iota
+	familyIPv6
+	familyMixed
+	familyUnix
+	familyUnspec
+	familyCount
+)
+
+// roundTripInput is a random version 2 header along with the Header it should parse to
+type roundTripInput struct {
+	payload []byte
+	want    *Header
+}
+
+func randomAddr(rand *rand.Rand, ipv6 bool) netip.AddrPort {
+	port := uint16(rand.Intn(0x10000))
+	if ipv6 {
+		var addr [16]byte
+		rand.Read(addr[:])
+		// IPv4-mapped addresses would be sent as IPv4
+		addr[0] = 0x20
+		return netip.AddrPortFrom(netip.AddrFrom16(addr), port)
+	}
+	var addr [4]byte
+	rand.Read(addr[:])
+	return netip.AddrPortFrom(netip.AddrFrom4(addr), port)
+}
+
+func randomTLVs(rand *rand.Rand) []TLV {
+	var tlvs []TLV
+	hasCRC32C := false
+	for range rand.Intn(6) {
+		tlvType := byte(rand.Intn(0x100))
+		if rand.Intn(2) == 0 {
+			knownTypes := []byte{TLVTypeALPN, TLVTypeAuthority, TLVTypeCRC32C, TLVTypeNoop, TLVTypeUniqueID, TLVTypeMinCustom}
+			tlvType = knownTypes[rand.Intn(len(knownTypes))]
+		}
+		// A header has (at most) one checksum
+		if tlvType == TLVTypeCRC32C {
+			if hasCRC32C {
+				continue
+			}
+			hasCRC32C = true
+		}
+		value := make([]byte, rand.Intn(MaxUniqueIDLen+1))
+		rand.Read(value)
+		tlvs = append(tlvs, TLV{Type: tlvType, Value: value})
+	}
+	return tlvs
+}
+
+func (roundTripInput) Generate(rand *rand.Rand, size int) reflect.Value {
+	transport := ProxyStream
+	if rand.Intn(2) == 0 {
+		transport = ProxyDgram
+	}
+	tlvs := randomTLVs(rand)
+
+	var payload []byte
+	var err error
+	want := &Header{
+		Version:   2,
+		Command:   CommandProxy,
+		Transport: transport,
+		TLVs:      tlvs,
+	}
+	switch rand.Intn(familyCount) {
+	case familyIPv4:
+		want.Source = randomAddr(rand, false)
+		want.Destination = randomAddr(rand, false)
+		payload, err = MakePayload(transport, want.Source, want.Destination, tlvs)
+	case familyIPv6:
+		want.Source = randomAddr(rand, true)
+		want.Destination = randomAddr(rand, true)
+		payload, err = MakePayload(transport, want.Source, want.Destination, tlvs)
+	case familyMixed:
+		src := randomAddr(rand, false)
+		want.Destination = randomAddr(rand, true)
+		payload, err = MakePayload(transport, src, want.Destination, tlvs)
+		want.Source = netip.AddrPortFrom(netip.AddrFrom16(src.Addr().As16()), src.Port())
+	case familyUnix:
+		// Unix socket paths are not parsed, so only the command, transport and TLVs are kept
+		addrs := make([]byte, addrLenUnix)
+		rand.Read(addrs)
+		payload, err = makePayload(CommandProxy, AFUnix|transport, addrs, tlvs)
+	case familyUnspec:
+		want.Command = CommandLocal
+		want.Transport = ProxyUnspec
+		payload, err = MakePayload(ProxyUnspec, netip.AddrPort{}, netip.AddrPort{}, tlvs)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	return reflect.ValueOf(roundTripInput{payload: payload, want: want})
+}
+
+func headersEqual(got *Header, want *Header) bool {
+	if got.Version != want.Version || got.Command != want.Command || got.Transport != want.Transport ||
+		got.Source != want.Source || got.Destination != want.Destination || len(got.TLVs) != len(want.TLVs) {
+		return false
+	}
+	for i, tlv := range want.TLVs {
+		if got.TLVs[i].Type != tlv.Type {
+			return false
+		}
+		// The checksum is computed while building the header, and verified by Parse
+		if tlv.Type == TLVTypeCRC32C {
+			if len(got.TLVs[i].Value) != crc32cLen {
+				return false
+			}
+			continue
+		}
+		if !bytes.Equal(got.TLVs[i].Value, tlv.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRoundTrip(t *testing.T) {
+	err := quick.Check(func(input roundTripInput) bool {
+		got, length, err := Parse(append(bytes.Clone(input.payload), "data"...))
+		if err != nil {
+			t.Logf("Parse(%x): %v", input.payload, err)
+			return false
+		}
+		if length != len(input.payload) {
+			t.Logf("Parse(%x) consumed %d bytes instead of %d", input.payload, length, len(input.payload))
+			return false
+		}
+		if !headersEqual(got, input.want) {
+			t.Logf("Parse(%x) = %+v, want %+v", input.payload, got, input.want)
+			return false
+		}
+		return true
+	}, &quick.Config{MaxCount: 2000})
+	if err != nil {
+		t.Error(err)
+	}
+}
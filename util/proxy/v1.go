@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+const v1MaxLength = 107
+
+// MakePayloadV1 builds a text (version 1) PROXY protocol header.
+// Version 1 only supports stream transports; addresses that are not valid IPs produce an UNKNOWN header.
+func MakePayloadV1(proto Transport, srcAddr netip.AddrPort, dstAddr netip.AddrPort) ([]byte, error) {
+	if proto == ProxyDgram {
+		return nil, errors.New("PROXY protocol v1 only supports stream transports")
+	}
+
+	if !srcAddr.IsValid() || !dstAddr.IsValid() || proto == ProxyUnspec {
+		return []byte("PROXY UNKNOWN\r\n"), nil
+	}
+
+	srcIP := srcAddr.Addr().Unmap()
+	dstIP := dstAddr.Addr().Unmap()
+
+	family := "TCP4"
+	if srcIP.Is6() || dstIP.Is6() {
+		family = "TCP6"
+		srcIP = netip.AddrFrom16(srcIP.As16())
+		dstIP = netip.AddrFrom16(dstIP.As16())
+	}
+
+	payload := fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcIP.WithZone(""), dstIP.WithZone(""), srcAddr.Port(), dstAddr.Port())
+	if len(payload) > v1MaxLength {
+		return nil, fmt.Errorf("PROXY protocol v1 header too long (%d bytes)", len(payload))
+	}
+	return []byte(payload), nil
+}
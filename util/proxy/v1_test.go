@@ -0,0 +1,86 @@
+package proxy_test
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/Doridian/foxIngress/util/proxy"
+)
+
+// Examples from section 2.1 of https://www.haproxy.org/download/3.0/doc/proxy-protocol.txt
+func TestMakePayloadV1(t *testing.T) {
+	tests := []struct {
+		name  string
+		proto proxy.Transport
+		src   netip.AddrPort
+		dst   netip.AddrPort
+		want  string
+	}{
+		{
+			name:  "TCP4",
+			proto: proxy.ProxyStream,
+			src:   netip.MustParseAddrPort("192.168.0.1:56324"),
+			dst:   netip.MustParseAddrPort("192.168.0.11:443"),
+			want:  "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n",
+		},
+		{
+			name:  "TCP4 worst case",
+			proto: proxy.ProxyStream,
+			src:   netip.MustParseAddrPort("255.255.255.255:65535"),
+			dst:   netip.MustParseAddrPort("255.255.255.255:65535"),
+			want:  "PROXY TCP4 255.255.255.255 255.255.255.255 65535 65535\r\n",
+		},
+		{
+			name:  "TCP4 IPv4-mapped",
+			proto: proxy.ProxyStream,
+			src:   netip.MustParseAddrPort("[::ffff:192.168.0.1]:56324"),
+			dst:   netip.MustParseAddrPort("[::ffff:192.168.0.11]:443"),
+			want:  "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n",
+		},
+		{
+			name:  "TCP6",
+			proto: proxy.ProxyStream,
+			src:   netip.MustParseAddrPort("[2001:db8::1]:56324"),
+			dst:   netip.MustParseAddrPort("[2001:db8::11]:443"),
+			want:  "PROXY TCP6 2001:db8::1 2001:db8::11 56324 443\r\n",
+		},
+		{
+			name:  "TCP6 worst case",
+			proto: proxy.ProxyStream,
+			src:   netip.MustParseAddrPort("[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535"),
+			dst:   netip.MustParseAddrPort("[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535"),
+			want:  "PROXY TCP6 ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff 65535 65535\r\n",
+		},
+		{
+			name:  "UNKNOWN without addresses",
+			proto: proxy.ProxyStream,
+			want:  "PROXY UNKNOWN\r\n",
+		},
+		{
+			name:  "UNKNOWN transport",
+			proto: proxy.ProxyUnspec,
+			src:   netip.MustParseAddrPort("192.168.0.1:56324"),
+			dst:   netip.MustParseAddrPort("192.168.0.11:443"),
+			want:  "PROXY UNKNOWN\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := proxy.MakePayloadV1(tt.proto, tt.src, tt.dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMakePayloadV1Datagram(t *testing.T) {
+	_, err := proxy.MakePayloadV1(proxy.ProxyDgram, netip.MustParseAddrPort("192.168.0.1:56324"), netip.MustParseAddrPort("192.168.0.11:443"))
+	if err == nil {
+		t.Error("expected an error for a datagram transport")
+	}
+}
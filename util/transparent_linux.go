@@ -0,0 +1,36 @@
+//go:build linux
+
+package util
+
+import (
+	"errors"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// TransparentControl allows a socket to bind to non-local addresses (such as the address of a client we proxy for).
+// It needs CAP_NET_ADMIN and policy routing that delivers replies to those addresses back to us.
+func TransparentControl(network string, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		switch network {
+		case "tcp4", "udp4":
+			sockErr = errors.Join(
+				unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1),
+				unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_FREEBIND, 1),
+			)
+		case "tcp6", "udp6":
+			sockErr = errors.Join(
+				unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1),
+				unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_FREEBIND, 1),
+			)
+		default:
+			sockErr = errors.New("transparent sockets are only supported for TCP and UDP over IP")
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
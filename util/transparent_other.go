@@ -0,0 +1,12 @@
+//go:build !linux
+
+package util
+
+import (
+	"errors"
+	"syscall"
+)
+
+func TransparentControl(network string, address string, c syscall.RawConn) error {
+	return errors.New("transparent sockets are only supported on Linux")
+}